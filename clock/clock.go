@@ -0,0 +1,84 @@
+// Package clock provides the time source used by go-dcc to time the
+// signal sent to the tracks.
+//
+// The System clock uses the real time. The Virtual clock only moves
+// forward when slept on or advanced, which allows tests to check the
+// exact timing of the signal produced by go-dcc, quickly and without
+// depending on the load of the machine.
+package clock
+
+import (
+	"sync"
+	"time"
+)
+
+// pollMax is the longest sleep which System performs by actively
+// polling the clock. For latencies under 100us, it is not possible to
+// sleep reliably with syscall.Nanosleep().
+const pollMax = time.Millisecond
+
+// Clock provides the current time and a way to wait.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+	// Sleep blocks for the given duration.
+	Sleep(d time.Duration)
+}
+
+// System is the Clock backed by the time package.
+var System Clock = systemClock{}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+// Sleep actively polls the clock for short durations, in order to
+// keep bits accurate, and uses time.Sleep() for the rest.
+func (systemClock) Sleep(d time.Duration) {
+	if d > pollMax {
+		time.Sleep(d)
+		return
+	}
+	now := time.Now()
+	for time.Since(now) < d {
+	}
+}
+
+// Virtual is a Clock whose time only moves forward when Sleep() or
+// Advance() are called. Sleep returns immediately. The zero value is
+// ready to use and starts at the zero time. Virtual is safe for
+// concurrent use.
+type Virtual struct {
+	mux sync.Mutex
+	now time.Time
+}
+
+// NewVirtual returns a Virtual clock starting at the given time.
+func NewVirtual(start time.Time) *Virtual {
+	return &Virtual{now: start}
+}
+
+// Now returns the current virtual time.
+func (v *Virtual) Now() time.Time {
+	v.mux.Lock()
+	defer v.mux.Unlock()
+	return v.now
+}
+
+// Sleep advances the virtual time by d.
+func (v *Virtual) Sleep(d time.Duration) {
+	v.Advance(d)
+}
+
+// Advance moves the virtual time forward by d. Negative durations
+// are ignored.
+func (v *Virtual) Advance(d time.Duration) {
+	if d <= 0 {
+		return
+	}
+	v.mux.Lock()
+	defer v.mux.Unlock()
+	v.now = v.now.Add(d)
+}
@@ -0,0 +1,33 @@
+package clock
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSystem(t *testing.T) {
+	for _, d := range []time.Duration{100 * time.Microsecond, 5 * time.Millisecond} {
+		start := System.Now()
+		System.Sleep(d)
+		if elapsed := System.Now().Sub(start); elapsed < d {
+			t.Errorf("slept %s, expected at least %s", elapsed, d)
+		}
+	}
+}
+
+func TestVirtual(t *testing.T) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	v := NewVirtual(start)
+	v.Sleep(time.Hour)
+	v.Advance(58 * time.Microsecond)
+	v.Advance(-time.Second)
+	if elapsed := v.Now().Sub(start); elapsed != time.Hour+58*time.Microsecond {
+		t.Error("bad virtual time: ", elapsed)
+	}
+
+	var zero Virtual
+	zero.Sleep(time.Second)
+	if !zero.Now().Equal(time.Time{}.Add(time.Second)) {
+		t.Error("zero value should start at the zero time")
+	}
+}
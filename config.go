@@ -9,6 +9,12 @@ import (
 // Config allows to store configuration settings to initialize go-dcc.
 type Config struct {
 	Locomotives []*Locomotive `json:"locomotives"`
+	Turnouts    []*Turnout    `json:"turnouts,omitempty"`
+	Signals     []*Signal     `json:"signals,omitempty"`
+	Consists    []*Consist    `json:"consists,omitempty"`
+
+	// RailCom enables the RailCom cutout on the tracks.
+	RailCom bool `json:"railcom,omitempty"`
 }
 
 // LoadConfig parses a configuration file and returns a Config object.
@@ -22,7 +28,8 @@ func LoadConfig(path string) (*Config, error) {
 	if err != nil {
 		return nil, err
 	}
-	log.Printf("Loaded configuration for %d locomotive(s)", len(cfg.Locomotives))
+	log.Printf("Loaded configuration for %d locomotive(s), %d turnout(s), %d signal(s) and %d consist(s)",
+		len(cfg.Locomotives), len(cfg.Turnouts), len(cfg.Signals), len(cfg.Consists))
 	return &cfg, nil
 }
 
@@ -8,7 +8,7 @@ func TestLoadConfig(t *testing.T) {
 		t.Error("error loading valid config")
 	}
 
-	if len(cfg.Locomotives) != 3 {
+	if len(cfg.Locomotives) != 3 || len(cfg.Turnouts) != 1 || len(cfg.Signals) != 1 {
 		t.Error("config not parsed correctly")
 	}
 
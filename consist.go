@@ -0,0 +1,41 @@
+package dcc
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ConsistMember represents a Locomotive in a Consist. Members are
+// referenced by the Locomotive name. Reversed members face backwards
+// and therefore run in the opposite direction to the consist.
+type ConsistMember struct {
+	Name     string `json:"name"`
+	Reversed bool   `json:"reversed"`
+}
+
+// Consist represents a group of locomotives that run together, i.e.
+// double-headed trains.
+//
+// The Controller can drive a consist by sending the same speed and
+// direction to every member (a software consist). Additionally, when
+// Address (1-127) is set, the members' decoders can be placed in an
+// advanced consist, so that they respond to packets sent to that
+// address.
+type Consist struct {
+	Name    string          `json:"name"`
+	Address uint8           `json:"address"`
+	Members []ConsistMember `json:"members"`
+}
+
+func (cs *Consist) String() string {
+	members := make([]string, 0, len(cs.Members))
+	for _, m := range cs.Members {
+		if m.Reversed {
+			members = append(members, m.Name+"<")
+		} else {
+			members = append(members, m.Name+">")
+		}
+	}
+	return fmt.Sprintf("%s:%d |%s|", cs.Name, cs.Address,
+		strings.Join(members, "|"))
+}
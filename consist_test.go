@@ -0,0 +1,23 @@
+package dcc
+
+import "testing"
+
+func TestConsistString(t *testing.T) {
+	cs := &Consist{
+		Name:    "c1",
+		Address: 10,
+		Members: []ConsistMember{
+			{Name: "loco1"},
+			{Name: "loco2", Reversed: true},
+		},
+	}
+	if cs.String() != "c1:10 |loco1>|loco2<|" {
+		t.Error("bad string: ", cs.String())
+	}
+}
+
+func TestDirectionReverse(t *testing.T) {
+	if Forward.Reverse() != Backward || Backward.Reverse() != Forward {
+		t.Error("Reverse() does not work")
+	}
+}
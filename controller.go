@@ -1,14 +1,90 @@
 package dcc
 
-import "sync"
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"time"
 
-// CommandRepeat specifies how many times a single
-// packet is sent.
-var CommandRepeat = 30
+	"github.com/hsanjuan/go-dcc/railcom"
+)
+
+// CommandRepeat specifies how many times a single packet is sent
+// with high priority: commands, and locomotive packets when they are new
+// or change. Afterwards, locomotive packets are refreshed at the intervals
+// given by SpeedRefreshInterval, FunctionRefreshInterval and
+// BinaryStateRefreshInterval.
+var CommandRepeat = 5
+
+// POMRepeat specifies how many times operations mode (programming
+// on the main) packets are sent. Decoders only act upon them after
+// receiving two identical packets.
+var POMRepeat = 2
+
+// CVReadTimeout specifies how long ReadCV waits for the decoder
+// response before retrying.
+var CVReadTimeout = 500 * time.Millisecond
+
+// CVReadRetries specifies how many times ReadCV retries reading a
+// CV when the decoder does not respond.
+var CVReadRetries = 2
+
+// Errors returned by Controller operations.
+var (
+	// ErrNoRailCom is returned when reading CVs while the RailCom
+	// cutout is disabled or there is no RailCom source.
+	ErrNoRailCom = errors.New("RailCom is not available")
+	// ErrNoResponse is returned when a decoder does not respond
+	// to a read.
+	ErrNoResponse = errors.New("no response from decoder")
+	// ErrNack is returned when a decoder responds with NACK.
+	ErrNack = errors.New("decoder does not support the instruction")
+	// ErrTracksOff is returned when attempting operations which
+	// need powered tracks.
+	ErrTracksOff = errors.New("tracks are not powered")
+	// ErrRunning is returned when starting a Controller which is
+	// already running.
+	ErrRunning = errors.New("controller already running")
+	// ErrNotRunning is returned when stopping a Controller which is
+	// not running, or when queueing packets on it.
+	ErrNotRunning = errors.New("controller not running")
+)
+
+// TrackState represents the state of the tracks handled by a Controller.
+type TrackState int
+
+// TrackState values.
+const (
+	// TrackOff means the tracks are not powered.
+	TrackOff TrackState = iota
+	// TrackOn means the tracks are powered and the Controller
+	// sends the packets for every Locomotive.
+	TrackOn
+	// TrackEStop means the tracks are powered but the Controller
+	// only sends emergency stop packets to all locomotives, until
+	// the emergency stop is released.
+	TrackEStop
+)
+
+func (s TrackState) String() string {
+	switch s {
+	case TrackOff:
+		return "off"
+	case TrackOn:
+		return "on"
+	case TrackEStop:
+		return "estop"
+	default:
+		return fmt.Sprintf("TrackState(%d)", int(s))
+	}
+}
 
 // CommandMaxQueue specifies how many commands can
 // queue before sending a new command blocks
-// the sender
+// the sender (see Submit)
 var CommandMaxQueue = 3
 
 // Controller represents a DCC Control Station. The
@@ -17,24 +93,80 @@ var CommandMaxQueue = 3
 // the tracks.
 type Controller struct {
 	locomotives map[string]*Locomotive
+	turnouts    map[string]*Turnout
+	signals     map[string]*Signal
+	consists    map[string]*Consist
 	mux         sync.RWMutex
 	driver      Driver
 
-	started    bool
-	doneCh     chan bool
-	shutdownCh chan bool
-	commandCh  chan *Packet
+	hookMux      sync.Mutex
+	packetHook   func(p *Packet)
+	errorHandler func(err error)
+	railCom      bool
+	railComSrc   railcom.Source
+
+	readMux sync.Mutex
+	cvReads []*cvRead
+
+	stateMux sync.Mutex
+	state    TrackState
+	paused   map[*Locomotive]uint8
+
+	subMux sync.Mutex
+	subs   map[*Subscription]struct{}
+
+	// runMux serializes Start and Stop. shutdownCh and doneCh
+	// belong to the current run and are nil when not running.
+	// Senders to commandCh hold queueMux for reading, so that
+	// shutdownCh does not change under them.
+	runMux     sync.Mutex
+	queueMux   sync.RWMutex
+	shutdownCh chan struct{}
+	doneCh     chan struct{}
+	commandCh  chan command
+}
+
+// command is a packet queued for sending, along with the number
+// of times it should be sent and, for submitted packets, the Handle
+// to resolve once sent.
+type command struct {
+	packet *Packet
+	repeat int
+	handle *Handle
+}
+
+// cvRead is a ReadCV() call waiting for the response to its packet.
+type cvRead struct {
+	packet *Packet
+	result chan cvResult
 }
 
-// NewController builds a Controller.
+type cvResult struct {
+	value byte
+	err   error
+}
+
+// deliver passes a result to the reader without blocking.
+func (r *cvRead) deliver(value byte, err error) {
+	select {
+	case r.result <- cvResult{value, err}:
+	default:
+	}
+}
+
+// NewController builds a Controller. Drivers which implement
+// railcom.Source are used as RailCom source (see SetRailComSource).
 func NewController(d Driver) *Controller {
 	d.TracksOff()
+	src, _ := d.(railcom.Source)
 	return &Controller{
+		railComSrc:  src,
 		driver:      d,
 		locomotives: make(map[string]*Locomotive),
-		doneCh:      make(chan bool),
-		shutdownCh:  make(chan bool),
-		commandCh:   make(chan *Packet, CommandMaxQueue),
+		turnouts:    make(map[string]*Turnout),
+		signals:     make(map[string]*Signal),
+		consists:    make(map[string]*Consist),
+		commandCh:   make(chan command, CommandMaxQueue),
 	}
 }
 
@@ -44,12 +176,63 @@ func NewControllerWithConfig(d Driver, cfg *Config) *Controller {
 	c := NewController(d)
 
 	for _, loco := range cfg.Locomotives {
+		var fns map[uint8]bool
+		if loco.Functions != nil {
+			fns = make(map[uint8]bool)
+			for n, f := range loco.Functions {
+				fns[n] = f
+			}
+		}
 		c.AddLoco(&Locomotive{
-			Name:      loco.Name,
-			Address:   loco.Address,
-			Speed:     loco.Speed,
-			Direction: loco.Direction,
-			Fl:        loco.Fl})
+			Name:        loco.Name,
+			Address:     loco.Address,
+			LongAddress: loco.LongAddress,
+			Speed:       loco.Speed,
+			SpeedSteps:  loco.SpeedSteps,
+			Direction:   loco.Direction,
+			Fl:          loco.Fl,
+			F1:          loco.F1,
+			F2:          loco.F2,
+			F3:          loco.F3,
+			F4:          loco.F4,
+			Functions:   fns})
+	}
+
+	for _, t := range cfg.Turnouts {
+		c.AddTurnout(&Turnout{
+			Name:    t.Name,
+			Address: t.Address,
+			Thrown:  t.Thrown})
+	}
+
+	for _, s := range cfg.Signals {
+		var aspects map[string]byte
+		if s.Aspects != nil {
+			aspects = make(map[string]byte)
+			for n, a := range s.Aspects {
+				aspects[n] = a
+			}
+		}
+		c.AddSignal(&Signal{
+			Name:    s.Name,
+			Address: s.Address,
+			Aspect:  s.Aspect,
+			Aspects: aspects})
+	}
+
+	for _, cs := range cfg.Consists {
+		members := make([]ConsistMember, len(cs.Members))
+		copy(members, cs.Members)
+		c.AddConsist(&Consist{
+			Name:    cs.Name,
+			Address: cs.Address,
+			Members: members})
+	}
+
+	if cfg.RailCom {
+		if err := c.SetRailCom(true); err != nil {
+			c.report(err)
+		}
 	}
 	return c
 }
@@ -58,16 +241,28 @@ func NewControllerWithConfig(d Driver, cfg *Config) *Controller {
 // will start receiving packets if the controller is running.
 func (c *Controller) AddLoco(l *Locomotive) {
 	c.mux.Lock()
-	defer c.mux.Unlock()
 	c.locomotives[l.Name] = l
+	c.mux.Unlock()
+	l.setOnChange(c.locoChanged)
+	c.emitLoco(EventLocoAdded, l)
 }
 
 // RmLoco removes a DCC device from the controller. There
 // will be no longer packets sent to it.
 func (c *Controller) RmLoco(l *Locomotive) {
 	c.mux.Lock()
-	defer c.mux.Unlock()
+	_, ok := c.locomotives[l.Name]
 	delete(c.locomotives, l.Name)
+	c.mux.Unlock()
+	if ok {
+		l.setOnChange(nil)
+		c.emitLoco(EventLocoRemoved, l)
+	}
+}
+
+// locoChanged is called when the properties of a Locomotive change.
+func (c *Controller) locoChanged(l *Locomotive) {
+	c.emitLoco(EventLocoChanged, l)
 }
 
 // GetLoco retrieves a DCC device by its Name. The boolean is
@@ -90,63 +285,809 @@ func (c *Controller) Locos() []*Locomotive {
 	return locos
 }
 
+// AddTurnout adds a turnout to the controller so that it can be
+// thrown and closed.
+func (c *Controller) AddTurnout(t *Turnout) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.turnouts[t.Name] = t
+}
+
+// RmTurnout removes a turnout from the controller.
+func (c *Controller) RmTurnout(t *Turnout) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	delete(c.turnouts, t.Name)
+}
+
+// GetTurnout retrieves a turnout by its Name. The boolean is
+// true if the Turnout was found.
+func (c *Controller) GetTurnout(n string) (*Turnout, bool) {
+	c.mux.RLock()
+	defer c.mux.RUnlock()
+	t, ok := c.turnouts[n]
+	return t, ok
+}
+
+// Turnouts returns a list of all registered Turnouts.
+func (c *Controller) Turnouts() []*Turnout {
+	c.mux.RLock()
+	defer c.mux.RUnlock()
+	turnouts := make([]*Turnout, 0, len(c.turnouts))
+	for _, t := range c.turnouts {
+		turnouts = append(turnouts, t)
+	}
+	return turnouts
+}
+
+// ThrowTurnout sets a turnout to the diverging route. The accessory
+// packets activating and then deactivating the turnout output are sent
+// AccessoryRepeat times each. It returns an error if the turnout
+// address is not valid or the packets cannot be queued (see Command).
+func (c *Controller) ThrowTurnout(t *Turnout) error {
+	return c.setTurnout(t, true)
+}
+
+// CloseTurnout sets a turnout to the straight route. The accessory
+// packets activating and then deactivating the turnout output are sent
+// AccessoryRepeat times each. It returns an error if the turnout
+// address is not valid or the packets cannot be queued (see Command).
+func (c *Controller) CloseTurnout(t *Turnout) error {
+	return c.setTurnout(t, false)
+}
+
+func (c *Controller) setTurnout(t *Turnout, thrown bool) error {
+	on, off, err := t.packets(thrown)
+	if err != nil {
+		return err
+	}
+
+	for _, p := range []*Packet{on, off} {
+		if err := c.queue(p, AccessoryRepeat); err != nil {
+			return err
+		}
+	}
+	t.setThrown(thrown)
+	return nil
+}
+
+// AddSignal adds a signal to the controller so that its aspect
+// can be set.
+func (c *Controller) AddSignal(s *Signal) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.signals[s.Name] = s
+}
+
+// RmSignal removes a signal from the controller.
+func (c *Controller) RmSignal(s *Signal) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	delete(c.signals, s.Name)
+}
+
+// GetSignal retrieves a signal by its Name. The boolean is
+// true if the Signal was found.
+func (c *Controller) GetSignal(n string) (*Signal, bool) {
+	c.mux.RLock()
+	defer c.mux.RUnlock()
+	s, ok := c.signals[n]
+	return s, ok
+}
+
+// Signals returns a list of all registered Signals.
+func (c *Controller) Signals() []*Signal {
+	c.mux.RLock()
+	defer c.mux.RUnlock()
+	signals := make([]*Signal, 0, len(c.signals))
+	for _, s := range c.signals {
+		signals = append(signals, s)
+	}
+	return signals
+}
+
+// SetAspect sets the aspect of a signal by its name. The extended
+// accessory packet is sent AccessoryRepeat times. It returns an
+// error if the signal does not support the given aspect, its
+// address is not valid or the packet cannot be queued (see Command).
+func (c *Controller) SetAspect(s *Signal, aspect string) error {
+	p, err := s.packet(aspect)
+	if err != nil {
+		return err
+	}
+
+	if err := c.queue(p, AccessoryRepeat); err != nil {
+		return err
+	}
+	s.setAspect(aspect)
+	return nil
+}
+
+// AddConsist adds a consist to the controller so that it can be
+// driven.
+func (c *Controller) AddConsist(cs *Consist) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.consists[cs.Name] = cs
+}
+
+// RmConsist removes a consist from the controller. Member locomotives
+// are not affected.
+func (c *Controller) RmConsist(cs *Consist) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	delete(c.consists, cs.Name)
+}
+
+// GetConsist retrieves a consist by its Name. The boolean is
+// true if the Consist was found.
+func (c *Controller) GetConsist(n string) (*Consist, bool) {
+	c.mux.RLock()
+	defer c.mux.RUnlock()
+	cs, ok := c.consists[n]
+	return cs, ok
+}
+
+// Consists returns a list of all registered Consists.
+func (c *Controller) Consists() []*Consist {
+	c.mux.RLock()
+	defer c.mux.RUnlock()
+	consists := make([]*Consist, 0, len(c.consists))
+	for _, cs := range c.consists {
+		consists = append(consists, cs)
+	}
+	return consists
+}
+
+// consistLocos returns the Locomotives in a consist. It returns
+// an error if any of them is not registered.
+func (c *Controller) consistLocos(cs *Consist) ([]*Locomotive, error) {
+	c.mux.RLock()
+	defer c.mux.RUnlock()
+	locos := make([]*Locomotive, 0, len(cs.Members))
+	for _, m := range cs.Members {
+		l, ok := c.locomotives[m.Name]
+		if !ok {
+			return nil, fmt.Errorf("consist %s: locomotive %s not registered",
+				cs.Name, m.Name)
+		}
+		locos = append(locos, l)
+	}
+	return locos, nil
+}
+
+// SetConsistSpeed sets the speed and direction of every member of a
+// consist (software consist). Reversed members receive the opposite
+// direction. It returns an error, without modifying any Locomotive, if
+// any member is not registered or its packets cannot be built.
+func (c *Controller) SetConsistSpeed(cs *Consist, speed uint8, dir Direction) error {
+	locos, err := c.consistLocos(cs)
+	if err != nil {
+		return err
+	}
+	dirs := make([]Direction, len(locos))
+	for i, l := range locos {
+		dirs[i] = dir
+		if cs.Members[i].Reversed {
+			dirs[i] = dir.Reverse()
+		}
+		snap := l.Snapshot()
+		_, err := NewSpeedDirectionAndLightPacket(l.address(),
+			Speed{Step: speed, Steps: snap.SpeedSteps}, dirs[i], snap.Fl)
+		if err != nil {
+			return fmt.Errorf("consist %s: locomotive %s: %w",
+				cs.Name, l.Name, err)
+		}
+	}
+
+	old := make([]LocoState, 0, len(locos))
+	for i, l := range locos {
+		var prev LocoState
+		err := l.Update(func(s *LocoState) {
+			prev = *s
+			s.Speed = speed
+			s.Direction = dirs[i]
+		})
+		if err != nil {
+			// Restore the members updated so far.
+			for j, s := range old {
+				locos[j].Update(func(st *LocoState) {
+					st.Speed = s.Speed
+					st.Direction = s.Direction
+				})
+			}
+			return fmt.Errorf("consist %s: %w", cs.Name, err)
+		}
+		old = append(old, prev)
+	}
+	return nil
+}
+
+// ActivateConsist places the members of a consist in an advanced
+// consist by sending them a Consist Control instruction with the
+// consist Address. The packets are sent POMRepeat times.
+func (c *Controller) ActivateConsist(cs *Consist) error {
+	if cs.Address == 0 || cs.Address > MaxShortAddress {
+		return fmt.Errorf("consist %s: address must be 1-%d",
+			cs.Name, MaxShortAddress)
+	}
+	return c.consistControl(cs, cs.Address)
+}
+
+// DeactivateConsist removes the members of a consist from their
+// advanced consist, so that they only respond to their own address.
+func (c *Controller) DeactivateConsist(cs *Consist) error {
+	return c.consistControl(cs, 0)
+}
+
+func (c *Controller) consistControl(cs *Consist, addr uint8) error {
+	locos, err := c.consistLocos(cs)
+	if err != nil {
+		return err
+	}
+	pkts := make([]*Packet, len(locos))
+	for i, l := range locos {
+		pkts[i], err = NewConsistControlPacket(l.address(),
+			addr, cs.Members[i].Reversed)
+		if err != nil {
+			return fmt.Errorf("consist %s: locomotive %s: %w",
+				cs.Name, l.Name, err)
+		}
+	}
+	for _, p := range pkts {
+		if err := c.queue(p, POMRepeat); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // Command allows to send a custom Packet to the tracks.
-// The packet will be sent CommandRepeat times.
-func (c *Controller) Command(p *Packet) {
-	c.commandCh <- p
+// The packet will be sent CommandRepeat times. Use Submit
+// to know when it has been sent or to cancel it. It blocks
+// while the command queue is full and returns ErrNotRunning
+// when the Controller is not running, or ErrStopped when it
+// stops first.
+func (c *Controller) Command(p *Packet) error {
+	return c.queue(p, CommandRepeat)
+}
+
+// queue submits a packet to be sent the given number of times,
+// without waiting for it to be sent.
+func (c *Controller) queue(p *Packet, repeat int) error {
+	_, err := c.Submit(context.Background(), p, &SubmitOptions{Repeat: repeat})
+	return err
+}
+
+// WriteCV queues an operations mode (programming on the main) packet
+// which writes value to the given configuration variable of a
+// Locomotive's decoder. The packet will be sent POMRepeat times.
+func (c *Controller) WriteCV(l *Locomotive, cv uint16, value byte) error {
+	return c.pom(NewPOMWriteBytePacket(l.address(), cv, value))
+}
+
+// WriteCVBit queues an operations mode packet which writes a single
+// bit (0-7) of a configuration variable of a Locomotive's decoder. The
+// packet will be sent POMRepeat times.
+func (c *Controller) WriteCVBit(l *Locomotive, cv uint16, bit uint8, value bool) error {
+	return c.pom(NewPOMWriteBitPacket(l.address(), cv, bit, value))
+}
+
+// VerifyCV queues an operations mode packet which asks a Locomotive's
+// decoder to verify the value of a configuration variable. The packet
+// will be sent POMRepeat times.
+func (c *Controller) VerifyCV(l *Locomotive, cv uint16, value byte) error {
+	return c.pom(NewPOMVerifyBytePacket(l.address(), cv, value))
+}
+
+// ReadCV reads a configuration variable of a Locomotive's decoder on the
+// main track using RailCom. It queues an operations mode verify packet,
+// which RailCom decoders answer with the value of the CV, and waits
+// CVReadTimeout for the response, retrying up to CVReadRetries times.
+// It needs the RailCom cutout enabled and a RailCom source (see
+// SetRailCom and SetRailComSource), and returns ErrTracksOff when the
+// Controller is not running.
+func (c *Controller) ReadCV(l *Locomotive, cv uint16) (byte, error) {
+	p, err := NewPOMVerifyBytePacket(l.address(), cv, 0)
+	if err != nil {
+		return 0, err
+	}
+	c.hookMux.Lock()
+	available := c.railCom && c.railComSrc != nil
+	c.hookMux.Unlock()
+	if !available {
+		return 0, ErrNoRailCom
+	}
+	if c.State() == TrackOff {
+		return 0, ErrTracksOff
+	}
+
+	r := &cvRead{packet: p, result: make(chan cvResult, 1)}
+	c.readMux.Lock()
+	c.cvReads = append(c.cvReads, r)
+	c.readMux.Unlock()
+	defer c.removeCVRead(r)
+
+	for i := 0; i <= CVReadRetries; i++ {
+		v, err := c.readCVAttempt(r)
+		if errors.Is(err, context.DeadlineExceeded) {
+			continue
+		}
+		if err != nil {
+			return 0, fmt.Errorf("reading CV%d of %s: %w", cv, l.Name, err)
+		}
+		return v, nil
+	}
+	return 0, fmt.Errorf("reading CV%d of %s: %w", cv, l.Name, ErrNoResponse)
+}
+
+// readCVAttempt submits the packet of a CV read and waits up to
+// CVReadTimeout for the response. It returns context.DeadlineExceeded
+// when none arrives in time.
+func (c *Controller) readCVAttempt(r *cvRead) (byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), CVReadTimeout)
+	defer cancel()
+	h, err := c.Submit(ctx, r.packet, &SubmitOptions{Repeat: POMRepeat})
+	if err != nil {
+		return 0, err
+	}
+	done := h.Done()
+	for {
+		select {
+		case res := <-r.result:
+			return res.value, res.err
+		case <-done:
+			// Keep waiting for the response unless sending failed.
+			if err := h.Err(); err != nil && ctx.Err() == nil {
+				return 0, err
+			}
+			done = nil
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		}
+	}
+}
+
+func (c *Controller) removeCVRead(r *cvRead) {
+	c.readMux.Lock()
+	defer c.readMux.Unlock()
+	for i, cr := range c.cvReads {
+		if cr == r {
+			c.cvReads = append(c.cvReads[:i], c.cvReads[i+1:]...)
+			return
+		}
+	}
+}
+
+// pom queues an operations mode packet, or returns the error
+// building it.
+func (c *Controller) pom(p *Packet, err error) error {
+	if err != nil {
+		return err
+	}
+	return c.queue(p, POMRepeat)
+}
+
+// SetPacketHook sets a function which is called with every packet
+// after the Controller sends it to the tracks, i.e. to log them. It is
+// called from the Controller's sending loop, so it should return
+// quickly. A nil function removes the hook.
+func (c *Controller) SetPacketHook(f func(p *Packet)) {
+	c.hookMux.Lock()
+	defer c.hookMux.Unlock()
+	c.packetHook = f
+}
+
+// SetErrorHandler sets a function which is called with the errors
+// that happen while the Controller sends packets, i.e. when a
+// Locomotive's packets cannot be built or the Driver fails. By default,
+// errors are logged. Like the packet hook, it is called from the
+// Controller's sending loop. A nil function restores the default.
+func (c *Controller) SetErrorHandler(f func(err error)) {
+	c.hookMux.Lock()
+	defer c.hookMux.Unlock()
+	c.errorHandler = f
+}
+
+// SetRailCom enables or disables the RailCom cutout after every packet
+// sent by the Controller. Enabling it fails with ErrNoCutout when the
+// Controller's Driver does not implement CutoutDriver.
+func (c *Controller) SetRailCom(enabled bool) error {
+	if _, ok := c.driver.(CutoutDriver); enabled && !ok {
+		return ErrNoCutout
+	}
+	c.hookMux.Lock()
+	defer c.hookMux.Unlock()
+	c.railCom = enabled
+	return nil
+}
+
+// SetRailComSource sets the source of the data received during the
+// RailCom cutout, i.e. a RailCom detector. The Controller reads one
+// cutout from it after every cutout it produces, so ReadCutout() should
+// return promptly. A nil source disables reading RailCom data.
+func (c *Controller) SetRailComSource(src railcom.Source) {
+	c.hookMux.Lock()
+	defer c.hookMux.Unlock()
+	c.railComSrc = src
+}
+
+// RailCom returns true if the RailCom cutout is enabled.
+func (c *Controller) RailCom() bool {
+	c.hookMux.Lock()
+	defer c.hookMux.Unlock()
+	return c.railCom
+}
+
+// report passes an error to the error handler.
+func (c *Controller) report(err error) {
+	c.emit(Event{Type: EventError, Err: err})
+	c.hookMux.Lock()
+	handler := c.errorHandler
+	c.hookMux.Unlock()
+	if handler == nil {
+		log.Println("dcc:", err)
+		return
+	}
+	handler(err)
+}
+
+// readRailCom reads the data received during the cutout after the given
+// packet and passes the responses to the CV reads waiting for it.
+func (c *Controller) readRailCom(p *Packet, src railcom.Source) {
+	cutout, err := railcom.Next(src)
+	if err == io.EOF {
+		c.SetRailComSource(nil)
+		c.report(fmt.Errorf("RailCom source: %w", err))
+		return
+	}
+	if err != nil {
+		c.report(fmt.Errorf("reading RailCom after %s: %w", p.Describe(), err))
+		return
+	}
+
+	c.readMux.Lock()
+	defer c.readMux.Unlock()
+	for _, r := range c.cvReads {
+		if !r.packet.Equal(p) {
+			continue
+		}
+		for _, dg := range cutout.Channel2 {
+			switch d := dg.(type) {
+			case railcom.POMDatagram:
+				r.deliver(d.Value, nil)
+			case railcom.NackDatagram:
+				r.deliver(0, ErrNack)
+			}
+		}
+	}
+}
+
+// send sends a packet, followed by the RailCom cutout when enabled, and
+// calls the packet hook. Errors are reported and returned.
+func (c *Controller) send(p *Packet) error {
+	c.hookMux.Lock()
+	hook := c.packetHook
+	railCom := c.railCom
+	src := c.railComSrc
+	c.hookMux.Unlock()
+
+	if err := p.Send(c.driver); err != nil {
+		err = fmt.Errorf("sending %s: %w", p.Describe(), err)
+		c.report(err)
+		return err
+	}
+	if railCom {
+		if err := RailComCutout(c.driver); err != nil {
+			err = fmt.Errorf("RailCom cutout after %s: %w", p.Describe(), err)
+			c.report(err)
+			return err
+		}
+		if src != nil {
+			c.readRailCom(p, src)
+		}
+	}
+	if hook != nil {
+		hook(p)
+	}
+	return nil
 }
 
 // Start starts the controller: powers on the tracks
-// and starts sending packets on them.
-func (c *Controller) Start() {
+// and starts sending packets on them. It returns ErrRunning
+// if the Controller is already running. A stopped Controller
+// can be started again.
+func (c *Controller) Start() error {
+	_, err := c.start()
+	return err
+}
+
+// start starts the Controller and returns the channel which is
+// closed when this run finishes.
+func (c *Controller) start() (<-chan struct{}, error) {
+	c.runMux.Lock()
+	defer c.runMux.Unlock()
+	if c.shutdownCh != nil {
+		return nil, ErrRunning
+	}
+	c.queueMux.Lock()
+	c.shutdownCh = make(chan struct{})
+	c.queueMux.Unlock()
+	c.doneCh = make(chan struct{})
+	c.setState(TrackOn)
 	c.driver.TracksOn()
-	go c.run()
-	c.started = true
+	go c.run(c.shutdownCh, c.doneCh)
+	return c.doneCh, nil
 }
 
 // Stop shuts down the controller by stopping to send
-// packets and removing power from the tracks.
-func (c *Controller) Stop() {
-	if c.started {
-		c.shutdownCh <- true
-		<-c.doneCh
-		c.started = false
+// packets and removing power from the tracks. Submitted packets
+// which have not been sent fail with ErrStopped. It waits until
+// the tracks are off and returns ErrNotRunning if the Controller
+// is not running.
+func (c *Controller) Stop() error {
+	return c.stop(nil)
+}
+
+// stop stops the Controller. When done is not nil, it only stops the
+// run it belongs to.
+func (c *Controller) stop(done <-chan struct{}) error {
+	c.runMux.Lock()
+	defer c.runMux.Unlock()
+	if c.shutdownCh == nil || (done != nil && done != c.doneCh) {
+		return ErrNotRunning
+	}
+	close(c.shutdownCh)
+	<-c.doneCh
+	// Senders blocked on a full queue give up once shutdownCh is
+	// closed, and nothing else is queued after it is cleared.
+	c.queueMux.Lock()
+	c.shutdownCh = nil
+	c.queueMux.Unlock()
+	c.doneCh = nil
+	c.failQueued(ErrStopped)
+	c.setState(TrackOff)
+	return nil
+}
+
+// Run starts the Controller and keeps it running until the context is
+// done, when it stops it and returns the context error. It returns nil
+// if the Controller is stopped with Stop first, and ErrRunning if it
+// was already running.
+func (c *Controller) Run(ctx context.Context) error {
+	done, err := c.start()
+	if err != nil {
+		return err
+	}
+	select {
+	case <-ctx.Done():
+		// Fails if somebody else stopped it meanwhile, which is fine.
+		c.stop(done)
+		return ctx.Err()
+	case <-done:
+		return nil
+	}
+}
+
+// State returns the state of the tracks.
+func (c *Controller) State() TrackState {
+	c.stateMux.Lock()
+	defer c.stateMux.Unlock()
+	return c.state
+}
+
+func (c *Controller) setState(s TrackState) {
+	c.stateMux.Lock()
+	defer c.stateMux.Unlock()
+	c.changeState(s)
+}
+
+// changeState sets the state of the tracks and notifies subscribers
+// if it changed. The caller must hold stateMux.
+func (c *Controller) changeState(s TrackState) {
+	if c.state == s {
+		return
+	}
+	c.state = s
+	c.emit(Event{Type: EventTrackState, Track: s})
+}
+
+// EmergencyStop stops all locomotives immediately. The Controller
+// stops refreshing locomotives and sends broadcast emergency stop
+// packets continuously until ReleaseEmergencyStop is called. The speed
+// of every Locomotive is set to 0, so that they remain stopped
+// afterwards. It returns ErrTracksOff when the tracks are not
+// powered.
+func (c *Controller) EmergencyStop() error {
+	c.stateMux.Lock()
+	if c.state == TrackOff {
+		c.stateMux.Unlock()
+		return ErrTracksOff
+	}
+	c.changeState(TrackEStop)
+	c.paused = nil
+	c.stateMux.Unlock()
+
+	for _, l := range c.Locos() {
+		if l.Snapshot().Speed == 0 {
+			continue
+		}
+		// Locomotives whose packets cannot be built are not sent
+		// anyway.
+		l.Update(func(s *LocoState) { s.Speed = 0 })
+	}
+	return nil
+}
+
+// ReleaseEmergencyStop releases a previous EmergencyStop, after which
+// the Controller sends the packets for every Locomotive again.
+func (c *Controller) ReleaseEmergencyStop() {
+	c.stateMux.Lock()
+	defer c.stateMux.Unlock()
+	if c.state == TrackEStop {
+		c.changeState(TrackOn)
+	}
+}
+
+// EmergencyStopLoco stops a single Locomotive immediately. When the
+// Controller is running, the emergency stop packet is queued with high
+// priority (see Command). The Locomotive remains in emergency stop until
+// its properties are applied again or its speed changes (see
+// Locomotive.EmergencyStop). It returns an error, leaving the Locomotive
+// untouched, if its address is not valid.
+func (c *Controller) EmergencyStopLoco(l *Locomotive) error {
+	s := l.Snapshot()
+	p, err := NewSpeedDirectionAndLightPacket(l.address(),
+		Speed{Steps: s.SpeedSteps, EStop: true}, s.Direction, s.Fl)
+	if err != nil {
+		return fmt.Errorf("locomotive %s: %w", l.Name, err)
+	}
+	l.EmergencyStop()
+	if err := c.queue(p, CommandRepeat); err != nil && !errors.Is(err, ErrNotRunning) {
+		return err
+	}
+	return nil
+}
+
+// PauseAll stops all locomotives, remembering their speed so that
+// ResumeAll can restore it. It returns ErrTracksOff when the tracks
+// are not powered.
+func (c *Controller) PauseAll() error {
+	locos := c.Locos()
+	c.stateMux.Lock()
+	defer c.stateMux.Unlock()
+	if c.state == TrackOff {
+		return ErrTracksOff
+	}
+	if c.paused == nil {
+		c.paused = make(map[*Locomotive]uint8)
+	}
+	for _, l := range locos {
+		if l.Snapshot().Speed == 0 {
+			continue
+		}
+		l.Update(func(s *LocoState) {
+			if s.Speed > 0 {
+				c.paused[l] = s.Speed
+				s.Speed = 0
+			}
+		})
+	}
+	return nil
+}
+
+// ResumeAll restores the speed of the locomotives stopped by PauseAll.
+// Locomotives whose speed was changed in the meantime, which are in
+// emergency stop or which were removed from the Controller, are left
+// untouched.
+func (c *Controller) ResumeAll() {
+	c.stateMux.Lock()
+	paused := c.paused
+	c.paused = nil
+	c.stateMux.Unlock()
+
+	for l, speed := range paused {
+		if _, ok := c.GetLoco(l.Name); !ok {
+			continue
+		}
+		l.Update(func(s *LocoState) {
+			if s.Speed == 0 && !s.EStop {
+				s.Speed = speed
+			}
+		})
 	}
 }
 
-func (c *Controller) run() {
-	idle := NewBroadcastIdlePacket(c.driver)
-	stop := NewBroadcastStopPacket(c.driver, Forward, false, true)
+// Paused returns true between PauseAll and ResumeAll.
+func (c *Controller) Paused() bool {
+	c.stateMux.Lock()
+	defer c.stateMux.Unlock()
+	return c.paused != nil
+}
+
+// run sends packets to the tracks until the Controller is stopped. The
+// scheduler decides which packet goes next, and idle packets are sent
+// when there is nothing else to send. During an emergency stop, only
+// commands are sent, and broadcast emergency stop packets instead of
+// idle packets.
+func (c *Controller) run(shutdownCh <-chan struct{}, doneCh chan<- struct{}) {
+	idle := NewBroadcastIdlePacket()
+	stop := NewBroadcastStopPacket(Forward, false, true)
+	clk := driverClock(c.driver)
+	s := newScheduler()
 	for {
 		select {
-		case <-c.shutdownCh:
-			for i := 0; i < CommandRepeat; i++ {
-				stop.Send()
-			}
+		case <-shutdownCh:
+			c.repeat(stop, CommandRepeat)
 			c.driver.TracksOff()
-			c.doneCh <- true
+			s.stop(ErrStopped)
+			close(doneCh)
 			return
-		case p := <-c.commandCh:
-			for i := 0; i < CommandRepeat; i++ {
-				p.Send()
-			}
+		case cmd := <-c.commandCh:
+			s.push(cmd)
+			continue
 		default:
-			c.mux.RLock()
-			{
-				// Idle and retry later
-				if len(c.locomotives) == 0 {
-					c.commandCh <- idle
-					c.mux.RUnlock()
-					break // from the select
-				}
-				for _, loco := range c.locomotives {
-					for i := 0; i < CommandRepeat; i++ {
-						loco.sendPackets(c.driver)
-					}
-				}
+		}
+
+		estop := c.State() == TrackEStop
+		if !estop {
+			c.updateLocos(s, clk.Now())
+		}
+		p := s.pick(clk.Now(), !estop)
+		if p == nil {
+			p = idle
+			if estop {
+				p = stop
+			}
+		}
+		if err := c.send(p); err != nil {
+			s.failed(err)
+		} else if s.sent(p, clk.Now()) {
+			c.emit(Event{Type: EventCommandSent, Packet: p})
+		}
+	}
+}
+
+// failQueued fails the commands waiting in the command queue.
+func (c *Controller) failQueued(err error) {
+	for {
+		select {
+		case cmd := <-c.commandCh:
+			if cmd.handle != nil {
+				cmd.handle.finish(err)
 			}
-			c.mux.RUnlock()
-			idle.PacketPause()
+		default:
+			return
+		}
+	}
+}
+
+// updateLocos passes the packets of every Locomotive to the scheduler.
+// Errors are reported once the Controller's lock is released, so that
+// error handlers can add and remove locomotives.
+func (c *Controller) updateLocos(s *scheduler, now time.Time) {
+	var errs []error
+	c.mux.RLock()
+	for _, l := range c.locomotives {
+		pkts, err := l.packets()
+		if err != nil {
+			errs = append(errs, err)
+		}
+		s.update(l, pkts, now)
+	}
+	c.mux.RUnlock()
+	s.prune()
+
+	for _, err := range errs {
+		c.report(err)
+	}
+}
+
+// repeat sends a packet n times, stopping on errors.
+func (c *Controller) repeat(p *Packet, n int) {
+	for i := 0; i < n; i++ {
+		if err := c.send(p); err != nil {
+			return
 		}
 	}
 }
@@ -1,15 +1,24 @@
 package dcc
 
 import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/hsanjuan/go-dcc/clock"
 	"github.com/hsanjuan/go-dcc/driver/dummy"
 )
 
 func TestNewController(t *testing.T) {
 	cfg, _ := LoadConfig("./test/config.json")
 	c := NewControllerWithConfig(&dummy.DCCDummy{}, cfg)
+	if len(c.Locos()) != 3 || len(c.Turnouts()) != 1 || len(c.Signals()) != 1 ||
+		len(c.Consists()) != 1 {
+		t.Error("should have loaded devices from the configuration")
+	}
 	c.Stop()
 }
 
@@ -37,21 +46,794 @@ func TestLocos(t *testing.T) {
 	}
 }
 
+// acceptCommands makes a Controller queue commands without running
+// it, so that tests can read them from the command queue. The returned
+// function undoes it.
+func acceptCommands(c *Controller) func() {
+	c.queueMux.Lock()
+	defer c.queueMux.Unlock()
+	c.shutdownCh = make(chan struct{})
+	return func() {
+		c.queueMux.Lock()
+		defer c.queueMux.Unlock()
+		c.shutdownCh = nil
+	}
+}
+
 func TestCommand(t *testing.T) {
+	must := mustBuild(t)
+	d := &dummy.DCCDummy{Time: &clock.Virtual{}}
+	c := NewController(d)
+	p := must(NewFunctionGroupOnePacket(Address{Number: 10}, true, false, false, false, false))
+	if err := c.Command(p); !errors.Is(err, ErrNotRunning) {
+		t.Error("should not queue commands when not running: ", err)
+	}
+	sent := recordPackets(c)
+	ch := make(chan Event, 1000)
+	defer c.Subscribe(ch).Unsubscribe()
+	c.Start()
+	if err := c.Command(p); err != nil {
+		t.Fatal(err)
+	}
+	waitEvent(t, ch, EventCommandSent)
+	c.Stop()
+
+	count := 0
+	for _, s := range sent() {
+		if s == p {
+			count++
+		}
+	}
+	if count != CommandRepeat {
+		t.Errorf("command sent %d times instead of %d", count, CommandRepeat)
+	}
+}
+
+func TestWriteCV(t *testing.T) {
+	must := mustBuild(t)
+	d := &dummy.DCCDummy{}
+	c := NewController(d)
+	l := &Locomotive{Name: "abc", Address: 3}
+	if err := c.WriteCV(l, 3, 20); !errors.Is(err, ErrNotRunning) {
+		t.Error("should not write CVs when not running: ", err)
+	}
+	acceptCommands(c)
+	c.WriteCV(l, 3, 20)
+	c.WriteCVBit(l, 29, 1, true)
+	cmd := <-c.commandCh
+	if cmd.repeat != POMRepeat {
+		t.Error("should repeat POM packets POMRepeat times")
+	}
+	expected := must(NewPOMWriteBytePacket(Address{Number: 3}, 3, 20))
+	if cmd.packet.String() != expected.String() {
+		t.Error("should have queued a POM write packet")
+	}
+	cmd = <-c.commandCh
+	expected = must(NewPOMWriteBitPacket(Address{Number: 3}, 29, 1, true))
+	if cmd.packet.String() != expected.String() {
+		t.Error("should have queued a POM write bit packet")
+	}
+}
+
+func TestTurnouts(t *testing.T) {
+	must := mustBuild(t)
+	d := &dummy.DCCDummy{}
+	c := NewController(d)
+	c.AddTurnout(&Turnout{Name: "t1", Address: 5})
+	if len(c.Turnouts()) != 1 {
+		t.Fatal("Turnouts() does not work")
+	}
+	to, ok := c.GetTurnout("t1")
+	if !ok {
+		t.Fatal("turnout should have been added")
+	}
+
+	if err := c.ThrowTurnout(to); !errors.Is(err, ErrNotRunning) || to.IsThrown() {
+		t.Error("should not throw the turnout when not running: ", err)
+	}
+	acceptCommands(c)
+	c.ThrowTurnout(to)
+	if !to.IsThrown() {
+		t.Error("turnout should be thrown")
+	}
+	on := <-c.commandCh
+	off := <-c.commandCh
+	if on.repeat != AccessoryRepeat || off.repeat != AccessoryRepeat {
+		t.Error("accessory packets should be sent AccessoryRepeat times")
+	}
+	if on.packet.String() != must(NewAccessoryOutputPacket(5, TurnoutThrownOutput, true)).String() ||
+		off.packet.String() != must(NewAccessoryOutputPacket(5, TurnoutThrownOutput, false)).String() {
+		t.Error("bad packets for throwing turnout")
+	}
+
+	c.CloseTurnout(to)
+	if to.IsThrown() {
+		t.Error("turnout should be closed")
+	}
+	on = <-c.commandCh
+	<-c.commandCh
+	if on.packet.String() != must(NewAccessoryOutputPacket(5, TurnoutClosedOutput, true)).String() {
+		t.Error("bad packet for closing turnout")
+	}
+
+	c.RmTurnout(to)
+	if _, ok := c.GetTurnout("t1"); ok {
+		t.Error("turnout should have been deleted")
+	}
+}
+
+func TestSignals(t *testing.T) {
+	must := mustBuild(t)
 	d := &dummy.DCCDummy{}
 	c := NewController(d)
-	p := NewBroadcastIdlePacket(d)
-	c.Command(p)
+	c.AddSignal(&Signal{Name: "s1", Address: 20})
+	if len(c.Signals()) != 1 {
+		t.Fatal("Signals() does not work")
+	}
+	s, ok := c.GetSignal("s1")
+	if !ok {
+		t.Fatal("signal should have been added")
+	}
+
+	acceptCommands(c)
+	if err := c.SetAspect(s, "clear"); err != nil {
+		t.Fatal(err)
+	}
+	if s.CurrentAspect() != "clear" {
+		t.Error("signal aspect should have been updated")
+	}
+	cmd := <-c.commandCh
+	if cmd.repeat != AccessoryRepeat ||
+		cmd.packet.String() != must(NewExtendedAccessoryPacket(20, DefaultAspects["clear"])).String() {
+		t.Error("bad extended accessory command")
+	}
+
+	if err := c.SetAspect(s, "purple"); err == nil {
+		t.Error("should fail setting an unknown aspect")
+	}
+	if s.CurrentAspect() != "clear" {
+		t.Error("aspect should not change on errors")
+	}
+
+	c.RmSignal(s)
+	if _, ok := c.GetSignal("s1"); ok {
+		t.Error("signal should have been deleted")
+	}
+}
+
+func TestConsists(t *testing.T) {
+	must := mustBuild(t)
+	d := &dummy.DCCDummy{}
+	c := NewController(d)
+	l1 := &Locomotive{Name: "l1", Address: 3}
+	l2 := &Locomotive{Name: "l2", Address: 2045, LongAddress: true}
+	c.AddLoco(l1)
+	c.AddLoco(l2)
+	c.AddConsist(&Consist{
+		Name:    "c1",
+		Address: 10,
+		Members: []ConsistMember{
+			{Name: "l1"},
+			{Name: "l2", Reversed: true},
+		},
+	})
+	if len(c.Consists()) != 1 {
+		t.Fatal("Consists() does not work")
+	}
+	cs, ok := c.GetConsist("c1")
+	if !ok {
+		t.Fatal("consist should have been added")
+	}
+
+	if err := c.SetConsistSpeed(cs, 12, Forward); err != nil {
+		t.Fatal(err)
+	}
+	if l1.Speed != 12 || l2.Speed != 12 {
+		t.Error("members should have the consist speed")
+	}
+	if l1.Direction != Forward || l2.Direction != Backward {
+		t.Error("reversed members should run backwards")
+	}
+
+	acceptCommands(c)
+	if err := c.ActivateConsist(cs); err != nil {
+		t.Fatal(err)
+	}
+	cmd := <-c.commandCh
+	if cmd.repeat != POMRepeat ||
+		cmd.packet.String() != must(NewConsistControlPacket(l1.address(), 10, false)).String() {
+		t.Error("bad consist control command")
+	}
+	cmd = <-c.commandCh
+	if cmd.packet.String() != must(NewConsistControlPacket(l2.address(), 10, true)).String() {
+		t.Error("bad consist control command for reversed member")
+	}
+
+	if err := c.DeactivateConsist(cs); err != nil {
+		t.Fatal(err)
+	}
+	cmd = <-c.commandCh
+	if cmd.packet.String() != must(NewConsistControlPacket(l1.address(), 0, false)).String() {
+		t.Error("bad consist deactivation command")
+	}
+	<-c.commandCh
+
+	c.RmLoco(l2)
+	if err := c.SetConsistSpeed(cs, 5, Backward); err == nil {
+		t.Error("should fail when a member is not registered")
+	}
+	if l1.Speed != 12 {
+		t.Error("members should not change on errors")
+	}
+	c.AddLoco(&Locomotive{Name: "bad", Address: 200})
+	cs.Members = []ConsistMember{{Name: "l1"}, {Name: "bad"}}
+	if err := c.SetConsistSpeed(cs, 5, Backward); !errors.Is(err, ErrBadAddress) {
+		t.Error("should fail when a member has a bad address: ", err)
+	}
+	if s := l1.Snapshot(); s.Speed != 12 || s.Direction != Forward {
+		t.Error("members should not change when another one fails: ", s)
+	}
+	if err := c.ActivateConsist(&Consist{Name: "c2"}); err == nil {
+		t.Error("should fail activating a consist without address")
+	}
+
+	c.RmConsist(cs)
+	if _, ok := c.GetConsist("c1"); ok {
+		t.Error("consist should have been deleted")
+	}
+}
+
+func TestPacketHook(t *testing.T) {
+	d := &dummy.DCCDummy{}
+	c := NewController(d)
+	sent := make(chan *Packet, 100)
+	c.SetPacketHook(func(p *Packet) {
+		select {
+		case sent <- p:
+		default:
+		}
+	})
+	c.AddLoco(&Locomotive{Name: "abc", Address: 10})
 	c.Start()
-	time.Sleep(250 * time.Millisecond)
+	p := <-sent
+	c.SetPacketHook(nil)
 	c.Stop()
+	if p.Describe() != "loco 10 (short) stop rev" {
+		t.Error("hook should have received the loco packets: ", p.Describe())
+	}
+}
+
+func TestErrorHandler(t *testing.T) {
+	d := &dummy.DCCDummy{}
+	c := NewController(d)
+	errs := make(chan error, 10)
+	c.SetErrorHandler(func(err error) {
+		select {
+		case errs <- err:
+		default:
+		}
+	})
+	c.AddLoco(&Locomotive{Name: "bad", Address: 200})
+	c.Start()
+	err := <-errs
+	c.Stop()
+	if !errors.Is(err, ErrBadAddress) {
+		t.Error("should have reported the bad loco address: ", err)
+	}
+	select {
+	case err := <-errs:
+		t.Error("errors should be reported once: ", err)
+	default:
+	}
+
+	if err := c.ThrowTurnout(&Turnout{Name: "t1", Address: 3000}); err == nil {
+		t.Error("should not throw turnouts with bad addresses")
+	}
+	if err := c.WriteCV(&Locomotive{Name: "abc", Address: 3}, 0, 1); err == nil {
+		t.Error("should not write CV0")
+	}
+
+	// Handlers can modify the Controller.
+	bad := &Locomotive{Name: "bad", Address: 200}
+	c.AddLoco(bad)
+	c.SetErrorHandler(func(err error) {
+		c.RmLoco(bad)
+		errs <- err
+	})
+	c.Start()
+	defer c.Stop()
+	select {
+	case <-errs:
+	case <-time.After(2 * time.Second):
+		t.Fatal("error handler should not block")
+	}
+	if _, ok := c.GetLoco("bad"); ok {
+		t.Error("handler should have removed the locomotive")
+	}
 }
 
 func TestStart(t *testing.T) {
-	c := NewController(&dummy.DCCDummy{})
+	c := NewController(&dummy.DCCDummy{Time: &clock.Virtual{}})
+	descs := make(chan string, 100)
+	c.SetPacketHook(func(p *Packet) {
+		select {
+		case descs <- p.Describe():
+		default:
+		}
+	})
 	c.Start()
-	time.Sleep(1 * time.Second)
+	waitPacket(t, descs, "idle")
 	c.AddLoco(&Locomotive{Name: "abc", Address: 10})
-	time.Sleep(1 * time.Second)
+	waitPacket(t, descs, "loco 10 (short) stop rev")
 	c.Stop()
 }
+
+func TestLifecycle(t *testing.T) {
+	c := NewController(&dummy.DCCDummy{Time: &clock.Virtual{}})
+	if err := c.Stop(); !errors.Is(err, ErrNotRunning) {
+		t.Error("should not stop before starting: ", err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := c.Start(); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.Start(); !errors.Is(err, ErrRunning) {
+			t.Error("should not start twice: ", err)
+		}
+		if c.State() != TrackOn {
+			t.Error("tracks should be on")
+		}
+
+		// The controller sends packets after every start.
+		sent := make(chan struct{})
+		var once sync.Once
+		c.SetPacketHook(func(p *Packet) { once.Do(func() { close(sent) }) })
+		<-sent
+
+		if err := c.Stop(); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.Stop(); !errors.Is(err, ErrNotRunning) {
+			t.Error("should not stop twice: ", err)
+		}
+		if c.State() != TrackOff {
+			t.Error("tracks should be off")
+		}
+	}
+}
+
+func TestLifecycleConcurrent(t *testing.T) {
+	c := NewController(&dummy.DCCDummy{Time: &clock.Virtual{}})
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				c.Start()
+				c.Stop()
+			}
+		}()
+	}
+	wg.Wait()
+	if err := c.Stop(); !errors.Is(err, ErrNotRunning) {
+		t.Error("every start should have been stopped: ", err)
+	}
+}
+
+func TestRun(t *testing.T) {
+	c := NewController(&dummy.DCCDummy{Time: &clock.Virtual{}})
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := make(chan error)
+	go func() { errCh <- c.Run(ctx) }()
+	for c.State() != TrackOn {
+		time.Sleep(time.Millisecond)
+	}
+	if err := c.Run(ctx); !errors.Is(err, ErrRunning) {
+		t.Error("should not run twice: ", err)
+	}
+	cancel()
+	if err := <-errCh; !errors.Is(err, context.Canceled) {
+		t.Error("should return the context error: ", err)
+	}
+	if c.State() != TrackOff {
+		t.Error("tracks should be off after Run returns")
+	}
+
+	// Stopped by Stop.
+	go func() { errCh <- c.Run(context.Background()) }()
+	for c.Stop() != nil {
+		time.Sleep(time.Millisecond)
+	}
+	if err := <-errCh; err != nil {
+		t.Error("should return nil when stopped: ", err)
+	}
+}
+
+// streamDriver records the bits sent to it, measured with a virtual
+// clock: "1" and "0" for exact bit durations, "|" for pauses and "x"
+// for anything else.
+type streamDriver struct {
+	clk clock.Virtual
+
+	mux    sync.Mutex
+	low    time.Time
+	stream strings.Builder
+}
+
+func (d *streamDriver) Clock() clock.Clock { return &d.clk }
+func (d *streamDriver) TracksOn()          {}
+func (d *streamDriver) TracksOff()         {}
+
+func (d *streamDriver) Low() {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	d.low = d.clk.Now()
+}
+
+func (d *streamDriver) High() {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	switch d.clk.Now().Sub(d.low) {
+	case BitOnePartDuration:
+		d.stream.WriteByte('1')
+	case BitZeroPartDuration:
+		d.stream.WriteByte('0')
+	case PacketSeparation:
+		d.stream.WriteByte('|')
+	default:
+		d.stream.WriteByte('x')
+	}
+}
+
+// CutoutStart writes "[" when the RailCom cutout starts on time.
+func (d *streamDriver) CutoutStart() {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	if d.clk.Now().Sub(d.low) == RailComCutoutStart {
+		d.stream.WriteByte('[')
+	} else {
+		d.stream.WriteByte('x')
+	}
+}
+
+// CutoutEnd writes "]" when the RailCom cutout ends on time.
+func (d *streamDriver) CutoutEnd() {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	if d.clk.Now().Sub(d.low) == RailComCutoutEnd {
+		d.stream.WriteByte(']')
+	} else {
+		d.stream.WriteByte('x')
+	}
+}
+
+func (d *streamDriver) String() string {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	return d.stream.String()
+}
+
+// recordPackets sets a packet hook which records the packets sent by
+// the Controller.
+func recordPackets(c *Controller) func() []*Packet {
+	var mux sync.Mutex
+	var sent []*Packet
+	c.SetPacketHook(func(p *Packet) {
+		mux.Lock()
+		defer mux.Unlock()
+		sent = append(sent, p)
+	})
+	return func() []*Packet {
+		mux.Lock()
+		defer mux.Unlock()
+		return append([]*Packet(nil), sent...)
+	}
+}
+
+// nonIdle returns the packets which are not idle packets.
+func nonIdle(pkts []*Packet) []*Packet {
+	idle := NewBroadcastIdlePacket()
+	var out []*Packet
+	for _, p := range pkts {
+		if !p.Equal(idle) {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+// checkLocoStream runs a Controller with a single locomotive and checks
+// that the stream on the tracks matches the packets sent, each followed
+// by suffix, and that new packets are sent CommandRepeat times before
+// being refreshed.
+func checkLocoStream(t *testing.T, c *Controller, d *streamDriver, suffix string) {
+	must := mustBuild(t)
+	speed := must(NewSpeedDirectionAndLightPacket(Address{Number: 10}, Speed{Step: 5}, Forward, false))
+	fl := must(NewFunctionGroupOnePacket(Address{Number: 10}, false, false, false, false, false))
+	sent := recordPackets(c)
+	c.AddLoco(&Locomotive{Name: "abc", Address: 10, Speed: 5, Direction: Forward})
+
+	c.Start()
+	for i := 0; i < 1000 && len(nonIdle(sent())) <= 2*CommandRepeat; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	c.Stop()
+
+	var expected strings.Builder
+	pkts := sent()
+	for _, p := range pkts {
+		expected.WriteString(p.String() + suffix)
+	}
+	if stream := d.String(); stream != expected.String() {
+		t.Errorf("unexpected stream:\n%s\nexpected:\n%s", stream, expected.String())
+	}
+
+	pkts = nonIdle(pkts)
+	if len(pkts) <= 2*CommandRepeat {
+		t.Fatal("not enough packets sent: ", len(pkts))
+	}
+	for i, p := range pkts[:2*CommandRepeat+1] {
+		want := speed
+		if i >= CommandRepeat && i < 2*CommandRepeat {
+			want = fl
+		}
+		if !p.Equal(want) {
+			t.Errorf("packet %d: expected %s, got %s", i, want.Describe(), p.Describe())
+		}
+	}
+}
+
+func TestControllerStream(t *testing.T) {
+	d := &streamDriver{}
+	checkLocoStream(t, NewController(d), d, "")
+}
+
+func TestRailCom(t *testing.T) {
+	c := NewController(&countDriver{})
+	if err := c.SetRailCom(true); !errors.Is(err, ErrNoCutout) {
+		t.Error("should not enable RailCom without cutout support: ", err)
+	}
+	if err := c.SetRailCom(false); err != nil || c.RailCom() {
+		t.Error("should be able to disable RailCom")
+	}
+
+	d := &streamDriver{}
+	c = NewControllerWithConfig(d, &Config{RailCom: true})
+	if !c.RailCom() {
+		t.Fatal("RailCom should be enabled by the configuration")
+	}
+	// A cutout follows every packet.
+	checkLocoStream(t, c, d, "[]")
+}
+
+// silentSource is a railcom.Source which never receives anything.
+type silentSource struct{}
+
+func (silentSource) ReadCutout() ([]byte, []byte, error) { return nil, nil, nil }
+
+func TestReadCV(t *testing.T) {
+	defer func(timeout time.Duration, retries int) {
+		CVReadTimeout = timeout
+		CVReadRetries = retries
+	}(CVReadTimeout, CVReadRetries)
+	CVReadTimeout = 50 * time.Millisecond
+	CVReadRetries = 1
+
+	d := &dummy.DCCDummy{CVs: map[uint16]byte{8: 151}, Time: &clock.Virtual{}}
+	c := NewController(d)
+	loco := &Locomotive{Name: "abc", Address: 3}
+	c.AddLoco(loco)
+	c.Start()
+	defer c.Stop()
+
+	if _, err := c.ReadCV(loco, 8); !errors.Is(err, ErrNoRailCom) {
+		t.Error("should not read without RailCom: ", err)
+	}
+	if err := c.SetRailCom(true); err != nil {
+		t.Fatal(err)
+	}
+
+	v, err := c.ReadCV(loco, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v != 151 {
+		t.Error("read wrong value: ", v)
+	}
+
+	if err := c.WriteCV(loco, 3, 20); err != nil {
+		t.Fatal(err)
+	}
+	v, err = c.ReadCV(loco, 3)
+	if err != nil || v != 20 {
+		t.Error("should read the written value: ", v, err)
+	}
+
+	if _, err := c.ReadCV(loco, 0); !errors.Is(err, ErrBadValue) {
+		t.Error("should not read CV0: ", err)
+	}
+
+	c.SetRailComSource(silentSource{})
+	if _, err := c.ReadCV(loco, 8); !errors.Is(err, ErrNoResponse) {
+		t.Error("should time out: ", err)
+	}
+
+	c.Stop()
+	if _, err := c.ReadCV(loco, 8); !errors.Is(err, ErrTracksOff) {
+		t.Error("should not read with the controller stopped: ", err)
+	}
+}
+
+// waitPacket waits until a packet with the given description is sent.
+func waitPacket(t *testing.T, descs <-chan string, desc string) {
+	t.Helper()
+	timeout := time.After(2 * time.Second)
+	for {
+		select {
+		case d := <-descs:
+			if d == desc {
+				return
+			}
+		case <-timeout:
+			t.Fatal("timed out waiting for ", desc)
+		}
+	}
+}
+
+func TestEmergencyStop(t *testing.T) {
+	c := NewController(&streamDriver{})
+	loco := &Locomotive{Name: "abc", Address: 10, Speed: 5, Direction: Forward}
+	c.AddLoco(loco)
+	descs := make(chan string, 10)
+	c.SetPacketHook(func(p *Packet) {
+		select {
+		case descs <- p.Describe():
+		default:
+		}
+	})
+
+	if c.State() != TrackOff {
+		t.Error("tracks should be off")
+	}
+	if err := c.EmergencyStop(); !errors.Is(err, ErrTracksOff) {
+		t.Error("should not emergency stop without power: ", err)
+	}
+
+	c.Start()
+	defer c.Stop()
+	if c.State() != TrackOn {
+		t.Error("tracks should be on")
+	}
+	waitPacket(t, descs, "loco 10 (short) speed 5/28 fwd")
+
+	if err := c.EmergencyStop(); err != nil {
+		t.Fatal(err)
+	}
+	if c.State() != TrackEStop || loco.Speed != 0 {
+		t.Error("should be in emergency stop")
+	}
+	waitPacket(t, descs, "all locos estop fwd")
+	for i := 0; i < 5; i++ {
+		if d := <-descs; d != "all locos estop fwd" {
+			t.Fatal("should only send emergency stop packets: ", d)
+		}
+	}
+
+	c.ReleaseEmergencyStop()
+	if c.State() != TrackOn {
+		t.Error("should have released the emergency stop")
+	}
+	waitPacket(t, descs, "loco 10 (short) stop fwd")
+
+	if err := c.EmergencyStopLoco(loco); err != nil {
+		t.Fatal(err)
+	}
+	waitPacket(t, descs, "loco 10 (short) estop fwd")
+	if !loco.Snapshot().EStop {
+		t.Error("locomotive should be in emergency stop")
+	}
+
+	bad := &Locomotive{Name: "bad", Address: 200, Speed: 3}
+	if err := c.EmergencyStopLoco(bad); !errors.Is(err, ErrBadAddress) {
+		t.Error("should fail with a bad address: ", err)
+	}
+	if s := bad.Snapshot(); s.Speed != 3 || s.EStop {
+		t.Error("should not stop a locomotive with a bad address: ", s)
+	}
+
+	c.Stop()
+	if c.State() != TrackOff {
+		t.Error("tracks should be off")
+	}
+}
+
+func TestEmergencyStopHoldsLocos(t *testing.T) {
+	c := NewController(&dummy.DCCDummy{Time: &clock.Virtual{}})
+	loco := &Locomotive{Name: "abc", Address: 3, Direction: Forward}
+	c.AddLoco(loco)
+
+	// Latch the emergency stop right after the first of the
+	// CommandRepeat packets for the new speed is sent, and record
+	// what follows.
+	latched := false
+	descs := make(chan string, 100)
+	c.SetPacketHook(func(p *Packet) {
+		d := p.Describe()
+		switch {
+		case latched:
+			select {
+			case descs <- d:
+			default:
+			}
+		case d == "loco 3 (short) speed 20/28 fwd":
+			if err := c.EmergencyStop(); err != nil {
+				t.Error(err)
+			}
+			latched = true
+		}
+	})
+	c.Start()
+	defer c.Stop()
+	if err := loco.SetSpeed(20); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 4*CommandRepeat; i++ {
+		if d := <-descs; d != "all locos estop fwd" {
+			t.Fatal("should not send locomotive packets during an emergency stop: ", d)
+		}
+	}
+}
+
+func TestPauseAll(t *testing.T) {
+	c := NewController(&streamDriver{})
+	l1 := &Locomotive{Name: "l1", Address: 10, Speed: 5}
+	l2 := &Locomotive{Name: "l2", Address: 11, Speed: 7}
+	l3 := &Locomotive{Name: "l3", Address: 12}
+	c.AddLoco(l1)
+	c.AddLoco(l2)
+	c.AddLoco(l3)
+
+	if err := c.PauseAll(); !errors.Is(err, ErrTracksOff) {
+		t.Error("should not pause without power: ", err)
+	}
+	c.Start()
+	defer c.Stop()
+
+	if err := c.PauseAll(); err != nil {
+		t.Fatal(err)
+	}
+	if !c.Paused() || l1.Speed != 0 || l2.Speed != 0 {
+		t.Error("should have paused all locomotives")
+	}
+
+	l2.mux.Lock()
+	l2.Speed = 2
+	l2.mux.Unlock()
+	l2.Apply()
+	c.RmLoco(l1)
+	c.ResumeAll()
+	if c.Paused() {
+		t.Error("should have resumed")
+	}
+	if l1.Speed != 0 || l2.Speed != 2 || l3.Speed != 0 {
+		t.Error("should only restore paused locomotives which did not change: ",
+			l1.Speed, l2.Speed, l3.Speed)
+	}
+
+	l1.Speed = 5
+	c.AddLoco(l1)
+	c.PauseAll()
+	c.ResumeAll()
+	if l1.Speed != 5 {
+		t.Error("should have restored the speed")
+	}
+
+	c.PauseAll()
+	c.EmergencyStopLoco(l1)
+	c.ResumeAll()
+	if s := l1.Snapshot(); s.Speed != 0 || !s.EStop {
+		t.Error("should not resume locomotives in emergency stop: ", s)
+	}
+}
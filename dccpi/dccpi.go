@@ -8,6 +8,7 @@ import (
 	"os/user"
 	"path/filepath"
 	"strconv"
+	"strings"
 
 	dcc "github.com/hsanjuan/go-dcc"
 	"github.com/hsanjuan/go-dcc/driver/dccpi"
@@ -49,11 +50,60 @@ stop sending packets.
 		Name:      "register",
 		ShortDesc: "Add DCC device",
 		LongDesc: `
-Usage: register <device_name> <address>
+Usage: register <device_name> <address> [short|long]
 
 This command allows to add a device so it can be controlled. The
 device will start receiving DCC control packets addressed to it.
 Note that unregistered devices may still act upon broadcast packets.
+
+Addresses over 127 use long (14-bit) addressing. Addresses under 128
+use short addressing unless "long" is specified.
+`},
+	"turnout": {
+		Name:      "turnout",
+		ShortDesc: "Add turnout",
+		LongDesc: `
+Usage: turnout <turnout_name> <address>
+
+This command allows to add a turnout operated by an accessory decoder so
+it can be thrown and closed. The address (1-2044) selects the accessory
+decoder and output pair controlling the turnout.
+`},
+	"throw": {
+		Name:      "throw",
+		ShortDesc: "Set a turnout to the diverging route",
+		LongDesc: `
+Usage: throw <turnout_name>
+
+This command sends accessory packets to set the given turnout to the
+diverging route.
+`},
+	"close": {
+		Name:      "close",
+		ShortDesc: "Set a turnout to the straight route",
+		LongDesc: `
+Usage: close <turnout_name>
+
+This command sends accessory packets to set the given turnout to the
+straight route.
+`},
+	"signal": {
+		Name:      "signal",
+		ShortDesc: "Add signal",
+		LongDesc: `
+Usage: signal <signal_name> <address>
+
+This command allows to add a signal operated by an extended accessory
+decoder so that its aspect can be set. The address must be 1-2044.
+`},
+	"aspect": {
+		Name:      "aspect",
+		ShortDesc: "Set the aspect of a signal",
+		LongDesc: `
+Usage: aspect <signal_name> <aspect>
+
+This command sends extended accessory packets to set the given aspect
+(i.e. stop, clear, approach) on a signal.
 `},
 	"unregister": {
 		Name:      "unregister",
@@ -61,8 +111,8 @@ Note that unregistered devices may still act upon broadcast packets.
 		LongDesc: `
 Usage: unregister <device_name>
 
-This command removes a device. The device will no longer receive any
-packets addressed to it.
+This command removes a device, turnout or signal. The device will no
+longer receive any packets addressed to it.
 `},
 	"save": {
 		Name:      "save",
@@ -90,7 +140,19 @@ it will print information on the named device.
 Usage: speed <device_name> <speed>
 
 This command sets the speed of the given device. The device will
-receive speed-and-direction packets with the given value.
+receive speed-and-direction packets with the given value. Speed 0 stops
+the device and the maximum speed depends on the configured speed steps
+(14, 28 or 126).
+`},
+	"steps": {
+		Name:      "steps",
+		ShortDesc: "Control locomotive speed steps",
+		LongDesc: `
+Usage: steps <device_name> <14|28|128>
+
+This command sets the number of speed steps the decoder of the given
+device is configured to use. 128 speed steps use the advanced operations
+speed instruction.
 `},
 	"direction": {
 		Name:      "direction",
@@ -100,15 +162,38 @@ Usage: direction <device_name> <backward|forward|reverse>
 
 This command sets the direction of a given device.
 `},
-	// 	"estop": {
-	// 		Name:      "estop",
-	// 		ShortDesc: "Emergency-stop all locomotives",
-	// 		LongDesc: `
-	// Usage: estop
-
-	// This commands sends a broadcast command which asks DCC devices to
-	// cut the power from all locomotives, causing their immediate stop.
-	// `},
+	"estop": {
+		Name:      "estop",
+		ShortDesc: "Emergency-stop locomotives",
+		LongDesc: `
+Usage: estop [device_name|off]
+
+Without arguments, this command sends broadcast packets which ask DCC
+devices to cut the power from all locomotives, causing their immediate
+stop. Emergency stop packets are sent until "estop off" is used. The
+speed of all locomotives is set to 0.
+
+When a device name is given, only that locomotive is stopped. It
+remains stopped until it is given a new speed.
+`},
+	"pause": {
+		Name:      "pause",
+		ShortDesc: "Stop all locomotives, remembering their speed",
+		LongDesc: `
+Usage: pause
+
+This command sets the speed of all locomotives to 0. Their speed is
+restored with "resume".
+`},
+	"resume": {
+		Name:      "resume",
+		ShortDesc: "Restore the speed of paused locomotives",
+		LongDesc: `
+Usage: resume
+
+This command restores the speed that locomotives had before "pause",
+unless it was changed in the meantime.
+`},
 	"fl": {
 		Name:      "fl",
 		ShortDesc: "Control the headlight of a locomotive",
@@ -117,6 +202,55 @@ Usage: fl <device_name> <on|off>
 
 This command allows to control the FL function of a locomotive, usually
 associated with the headlight.
+`},
+	"cv": {
+		Name:      "cv",
+		ShortDesc: "Write a configuration variable of a locomotive",
+		LongDesc: `
+Usage: cv <device_name> <cv> <value>
+
+This command writes a configuration variable (CV 1-1024) of a locomotive
+decoder on the main track (operations mode programming). The value must
+be between 0 and 255. Tracks must be powered for the command to be sent.
+`},
+	"cvread": {
+		Name:      "cvread",
+		ShortDesc: "Read a configuration variable of a locomotive",
+		LongDesc: `
+Usage: cvread <device_name> <cv>
+
+This command reads a configuration variable (CV 1-1024) of a locomotive
+decoder on the main track using RailCom. Tracks must be powered, RailCom
+must be enabled (see "railcom") and the decoder must support RailCom.
+`},
+	"fn": {
+		Name:      "fn",
+		ShortDesc: "Control the functions of a locomotive",
+		LongDesc: `
+Usage: fn <device_name> <function_number> <on|off>
+
+This command allows to control the functions (F0-F68) of a locomotive.
+F0 corresponds to FL, usually associated with the headlight.
+`},
+	"trace": {
+		Name:      "trace",
+		ShortDesc: "Show the packets sent to the tracks",
+		LongDesc: `
+Usage: trace <on|off>
+
+When on, a description of every packet sent to the tracks is printed
+(i.e. "loco 3 (short) speed 14/28 fwd"). Note that packets are sent
+continuously while tracks are powered.
+`},
+	"railcom": {
+		Name:      "railcom",
+		ShortDesc: "Enable or disable the RailCom cutout",
+		LongDesc: `
+Usage: railcom <on|off>
+
+When on, the RailCom cutout is inserted after every packet sent to the
+tracks, allowing RailCom decoders to send data back. The driver must
+support it.
 `},
 	"exit": {
 		Name:      "exit",
@@ -231,7 +365,7 @@ func printPrompt() {
 
 func (r *repl) shutdown() {
 	fmt.Println()
-	r.ctrl.Stop()
+	r.ctrl.Stop() // fails when already stopped
 	fmt.Println("Tracks powered off")
 	close(r.doneCh)
 }
@@ -245,11 +379,17 @@ func (r *repl) run() {
 	notReg := func() {
 		perr("Error: device not registered")
 	}
+	notTurnout := func() {
+		perr("Error: turnout not registered")
+	}
+	notSignal := func() {
+		perr("Error: signal not registered")
+	}
 
 	for {
-		var cmd, arg1, arg2 string
+		var cmd, arg1, arg2, arg3 string
 		printPrompt()
-		i, _ := fmt.Scanln(&cmd, &arg1, &arg2)
+		i, _ := fmt.Scanln(&cmd, &arg1, &arg2, &arg3)
 		if i == 0 {
 			continue
 		}
@@ -282,24 +422,44 @@ func (r *repl) run() {
 			}
 			switch arg1 {
 			case "on":
-				r.ctrl.Start()
+				if err := r.ctrl.Start(); err != nil {
+					perr("Error: " + err.Error())
+				}
 			case "off":
-				r.ctrl.Stop()
+				if err := r.ctrl.Stop(); err != nil {
+					perr("Error: " + err.Error())
+				}
 			default:
 				wrongArgs(cmd)
 			}
 		case "register":
-			if i != 3 {
+			if i != 3 && i != 4 {
 				wrongArgs(cmd)
 				break
 			}
-			n, err := strconv.ParseUint(arg2, 10, 8)
-			if err != nil {
-				perr("Error: wrong DCC address: " + err.Error())
+			n, err := strconv.ParseUint(arg2, 10, 16)
+			if err != nil || n > dcc.MaxLongAddress {
+				perr("Error: wrong DCC address")
+				break
+			}
+			long := n > dcc.MaxShortAddress
+			switch arg3 {
+			case "":
+			case "short":
+				if long {
+					perr("Error: short addresses must be under 128")
+					continue
+				}
+			case "long":
+				long = true
+			default:
+				wrongArgs(cmd)
+				continue
 			}
 			l := &dcc.Locomotive{
-				Name:    arg1,
-				Address: uint8(n),
+				Name:        arg1,
+				Address:     uint16(n),
+				LongAddress: long,
 			}
 			r.ctrl.AddLoco(l)
 		case "unregister":
@@ -307,6 +467,14 @@ func (r *repl) run() {
 				wrongArgs(cmd)
 				break
 			}
+			if t, ok := r.ctrl.GetTurnout(arg1); ok {
+				r.ctrl.RmTurnout(t)
+				break
+			}
+			if s, ok := r.ctrl.GetSignal(arg1); ok {
+				r.ctrl.RmSignal(s)
+				break
+			}
 			l, ok := r.ctrl.GetLoco(arg1)
 			if !ok {
 				notReg()
@@ -319,6 +487,14 @@ func (r *repl) run() {
 				break
 			}
 			if i == 2 {
+				if t, ok := r.ctrl.GetTurnout(arg1); ok {
+					fmt.Println(t.String())
+					break
+				}
+				if s, ok := r.ctrl.GetSignal(arg1); ok {
+					fmt.Println(s.String())
+					break
+				}
 				l, ok := r.ctrl.GetLoco(arg1)
 				if !ok {
 					notReg()
@@ -326,10 +502,26 @@ func (r *repl) run() {
 				}
 				fmt.Println(l.String())
 			} else {
+				fmt.Println("Tracks:", r.ctrl.State())
+				if r.ctrl.Paused() {
+					fmt.Println("Locomotives paused")
+				}
 				locos := r.ctrl.Locos()
 				for _, l := range locos {
 					fmt.Println(l.String())
 				}
+				turnouts := r.ctrl.Turnouts()
+				for _, t := range turnouts {
+					fmt.Println(t.String())
+				}
+				signals := r.ctrl.Signals()
+				for _, s := range signals {
+					fmt.Println(s.String())
+				}
+				consists := r.ctrl.Consists()
+				for _, cs := range consists {
+					fmt.Println(cs.String())
+				}
 			}
 		case "speed":
 			if i != 3 {
@@ -344,9 +536,41 @@ func (r *repl) run() {
 			n, err := strconv.ParseUint(arg2, 10, 8)
 			if err != nil {
 				perr("Wrong speed value: " + err.Error())
+				break
+			}
+			if max := l.Snapshot().SpeedSteps.Max(); uint8(n) > max {
+				perr(fmt.Sprintf("Wrong speed value: maximum speed step is %d", max))
+				break
+			}
+			if err := l.SetSpeed(uint8(n)); err != nil {
+				perr("Error: " + err.Error())
+			}
+		case "steps":
+			if i != 3 {
+				wrongArgs(cmd)
+				break
+			}
+			l, ok := r.ctrl.GetLoco(arg1)
+			if !ok {
+				notReg()
+				break
+			}
+			var steps dcc.SpeedSteps
+			switch arg2 {
+			case "14":
+				steps = dcc.SpeedSteps14
+			case "28":
+				steps = dcc.SpeedSteps28
+			case "128":
+				steps = dcc.SpeedSteps128
+			default:
+				wrongArgs(cmd)
+				continue
+			}
+			err := l.Update(func(s *dcc.LocoState) { s.SpeedSteps = steps })
+			if err != nil {
+				perr("Error: " + err.Error())
 			}
-			l.Speed = uint8(n)
-			l.Apply()
 		case "direction":
 			if i != 3 {
 				wrongArgs(cmd)
@@ -357,26 +581,58 @@ func (r *repl) run() {
 				notReg()
 				break
 			}
+			var err error
 			switch arg2 {
 			case "forward":
-				l.Direction = dcc.Forward
-				l.Apply()
+				err = l.SetDirection(dcc.Forward)
 			case "backward":
-				l.Direction = dcc.Backward
-				l.Apply()
+				err = l.SetDirection(dcc.Backward)
 			case "reverse":
-				l.Direction = (l.Direction + 1%2)
-				l.Apply()
+				err = l.Update(func(s *dcc.LocoState) {
+					s.Direction = s.Direction.Reverse()
+				})
+			default:
+				wrongArgs(cmd)
+			}
+			if err != nil {
+				perr("Error: " + err.Error())
+			}
+		case "estop":
+			if i > 2 {
+				wrongArgs(cmd)
+				break
+			}
+			switch {
+			case i == 1:
+				if err := r.ctrl.EmergencyStop(); err != nil {
+					perr("Error: " + err.Error())
+				}
+			case arg1 == "off":
+				r.ctrl.ReleaseEmergencyStop()
 			default:
+				l, ok := r.ctrl.GetLoco(arg1)
+				if !ok {
+					notReg()
+					break
+				}
+				if err := r.ctrl.EmergencyStopLoco(l); err != nil {
+					perr("Error: " + err.Error())
+				}
+			}
+		case "pause":
+			if i != 1 {
+				wrongArgs(cmd)
+				break
+			}
+			if err := r.ctrl.PauseAll(); err != nil {
+				perr("Error: " + err.Error())
+			}
+		case "resume":
+			if i != 1 {
 				wrongArgs(cmd)
+				break
 			}
-		// case "estop":
-		// 	if i != 1 {
-		// 		wrongArgs(cmd)
-		// 		break
-		// 	}
-		// 	estop := dcc.NewBroadcastStopPacket(r.driver, dcc.Forward, false, true)
-		// 	r.ctrl.Command(estop)
+			r.ctrl.ResumeAll()
 		case "fl":
 			if i != 3 {
 				wrongArgs(cmd)
@@ -387,20 +643,188 @@ func (r *repl) run() {
 				notReg()
 				break
 			}
+			var err error
 			switch arg2 {
 			case "on":
-				l.Fl = true
-				l.Apply()
+				err = l.SetFunction(0, true)
+			case "off":
+				err = l.SetFunction(0, false)
+			default:
+				wrongArgs(cmd)
+			}
+			if err != nil {
+				perr("Error: " + err.Error())
+			}
+		case "fn":
+			if i != 4 {
+				wrongArgs(cmd)
+				break
+			}
+			l, ok := r.ctrl.GetLoco(arg1)
+			if !ok {
+				notReg()
+				break
+			}
+			n, err := strconv.ParseUint(arg2, 10, 8)
+			if err != nil || n > dcc.MaxFunction {
+				perr(fmt.Sprintf("Error: function number must be 0-%d", dcc.MaxFunction))
+				break
+			}
+			switch arg3 {
+			case "on":
+				err = l.SetFunction(uint8(n), true)
+			case "off":
+				err = l.SetFunction(uint8(n), false)
+			default:
+				wrongArgs(cmd)
+			}
+			if err != nil {
+				perr("Error: " + err.Error())
+			}
+		case "cv":
+			if i != 4 {
+				wrongArgs(cmd)
+				break
+			}
+			l, ok := r.ctrl.GetLoco(arg1)
+			if !ok {
+				notReg()
+				break
+			}
+			cv, err := strconv.ParseUint(arg2, 10, 16)
+			if err != nil || cv < 1 || cv > 1024 {
+				perr("Error: CV number must be 1-1024")
+				break
+			}
+			v, err := strconv.ParseUint(arg3, 10, 8)
+			if err != nil {
+				perr("Error: wrong CV value: " + err.Error())
+				break
+			}
+			err = r.ctrl.WriteCV(l, uint16(cv), byte(v))
+			if err != nil {
+				perr("Error: " + err.Error())
+			}
+		case "cvread":
+			if i != 3 {
+				wrongArgs(cmd)
+				break
+			}
+			l, ok := r.ctrl.GetLoco(arg1)
+			if !ok {
+				notReg()
+				break
+			}
+			cv, err := strconv.ParseUint(arg2, 10, 16)
+			if err != nil || cv < 1 || cv > 1024 {
+				perr("Error: CV number must be 1-1024")
+				break
+			}
+			v, err := r.ctrl.ReadCV(l, uint16(cv))
+			if err != nil {
+				perr("Error: " + err.Error())
+				break
+			}
+			fmt.Printf("CV%d = %d\n", cv, v)
+		case "turnout":
+			if i != 3 {
+				wrongArgs(cmd)
+				break
+			}
+			n, err := strconv.ParseUint(arg2, 10, 16)
+			if err != nil || n < 1 || n > dcc.MaxAccessoryOutputAddress {
+				perr(fmt.Sprintf("Error: turnout address must be 1-%d",
+					dcc.MaxAccessoryOutputAddress))
+				break
+			}
+			r.ctrl.AddTurnout(&dcc.Turnout{
+				Name:    arg1,
+				Address: uint16(n),
+			})
+		case "throw", "close":
+			if i != 2 {
+				wrongArgs(cmd)
+				break
+			}
+			t, ok := r.ctrl.GetTurnout(arg1)
+			if !ok {
+				notTurnout()
+				break
+			}
+			var err error
+			if cmd == "throw" {
+				err = r.ctrl.ThrowTurnout(t)
+			} else {
+				err = r.ctrl.CloseTurnout(t)
+			}
+			if err != nil {
+				perr("Error: " + err.Error())
+			}
+		case "signal":
+			if i != 3 {
+				wrongArgs(cmd)
+				break
+			}
+			n, err := strconv.ParseUint(arg2, 10, 16)
+			if err != nil || n < 1 || n > dcc.MaxAccessoryOutputAddress {
+				perr(fmt.Sprintf("Error: signal address must be 1-%d",
+					dcc.MaxAccessoryOutputAddress))
+				break
+			}
+			r.ctrl.AddSignal(&dcc.Signal{
+				Name:    arg1,
+				Address: uint16(n),
+			})
+		case "aspect":
+			if i != 3 {
+				wrongArgs(cmd)
+				break
+			}
+			s, ok := r.ctrl.GetSignal(arg1)
+			if !ok {
+				notSignal()
+				break
+			}
+			err := r.ctrl.SetAspect(s, arg2)
+			if err != nil {
+				perr("Error: " + err.Error())
+				perr("Available aspects: " + strings.Join(s.AspectNames(), ", "))
+			}
+		case "trace":
+			if i != 2 {
+				wrongArgs(cmd)
+				break
+			}
+			switch arg1 {
+			case "on":
+				r.ctrl.SetPacketHook(func(p *dcc.Packet) {
+					fmt.Println(p.Describe())
+				})
 			case "off":
-				l.Fl = false
-				l.Apply()
+				r.ctrl.SetPacketHook(nil)
+			default:
+				wrongArgs(cmd)
+			}
+		case "railcom":
+			if i != 2 {
+				wrongArgs(cmd)
+				break
+			}
+			switch arg1 {
+			case "on", "off":
+				if err := r.ctrl.SetRailCom(arg1 == "on"); err != nil {
+					perr("Error: " + err.Error())
+				}
 			default:
 				wrongArgs(cmd)
 			}
 		case "save":
-			locos := r.ctrl.Locos()
 			cfg := &dcc.Config{
-				Locomotives: locos,
+				Locomotives: r.ctrl.Locos(),
+				Turnouts:    r.ctrl.Turnouts(),
+				Signals:     r.ctrl.Signals(),
+				Consists:    r.ctrl.Consists(),
+				RailCom:     r.ctrl.RailCom(),
 			}
 			err := cfg.Save(configFlag)
 			if err != nil {
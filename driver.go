@@ -1,5 +1,11 @@
 package dcc
 
+import (
+	"time"
+
+	"github.com/hsanjuan/go-dcc/clock"
+)
+
 // Driver can be implemented by any module to allow using go-dcc
 // on different platforms. dcc.Driver modules are in charge of
 // producing an electrical signal output (i.e. on a GPIO Pin)
@@ -17,3 +23,61 @@ type Driver interface {
 	// trains should stop after calling it.
 	TracksOff()
 }
+
+// AckDetector can be optionally implemented by Drivers which are able to
+// sense the acknowledgement that decoders produce on the programming
+// track: an increase of at least 60mA in the current drawn during 6ms.
+// Service mode operations which need to read from the decoder require
+// it.
+type AckDetector interface {
+	// ResetAck discards any previously detected acknowledgement.
+	ResetAck()
+	// Ack waits up to the given time window for an acknowledgement
+	// and returns true if one was detected since the last call to
+	// ResetAck().
+	Ack(window time.Duration) bool
+}
+
+// WaveformDriver can be optionally implemented by Drivers which are able to
+// output a whole packet at once, for example using DMA, PWM, SPI or kernel
+// buffers. Packet.Send() uses it when available instead of timing every
+// Low() and High() call itself, which makes the signal independent from Go
+// scheduling and garbage collection.
+type WaveformDriver interface {
+	// SendWaveform outputs a packet given as the durations of each of
+	// its half-bits. Even positions correspond to the low part of each
+	// bit and odd positions to the high part (see Packet.Waveform()).
+	// It should return once the packet has been sent.
+	SendWaveform(halfBits []time.Duration) error
+}
+
+// Clocked can be optionally implemented by Drivers which provide the Clock
+// used to time the signal sent to them. Drivers for real hardware do not
+// need it. Simulated drivers can return a clock.Virtual so that tests do
+// not depend on the real time.
+type Clocked interface {
+	// Clock returns the clock used when sending to this Driver.
+	Clock() clock.Clock
+}
+
+// driverClock returns the Clock for the given Driver, which is
+// clock.System unless the Driver implements Clocked.
+func driverClock(d Driver) clock.Clock {
+	if cd, ok := d.(Clocked); ok {
+		if clk := cd.Clock(); clk != nil {
+			return clk
+		}
+	}
+	return clock.System
+}
+
+// CutoutDriver can be optionally implemented by Drivers which are able to
+// produce the RailCom cutout, during which decoders send data back to the
+// command station. See RailComCutout().
+type CutoutDriver interface {
+	// CutoutStart stops powering the tracks by putting the booster
+	// outputs in a shorted or idle state.
+	CutoutStart()
+	// CutoutEnd powers the tracks again after a CutoutStart().
+	CutoutEnd()
+}
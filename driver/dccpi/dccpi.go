@@ -56,3 +56,14 @@ func (pi *DCCPi) TracksOff() {
 func (pi *DCCPi) TracksOn() {
 	BrakeGPIO.Low()
 }
+
+// CutoutStart activates the brake, shorting the booster outputs
+// during the RailCom cutout.
+func (pi *DCCPi) CutoutStart() {
+	BrakeGPIO.High()
+}
+
+// CutoutEnd releases the brake after the RailCom cutout.
+func (pi *DCCPi) CutoutEnd() {
+	BrakeGPIO.Low()
+}
@@ -3,13 +3,21 @@ package dummy
 import (
 	"bytes"
 	"fmt"
+	"sync"
 	"time"
+
+	"github.com/hsanjuan/go-dcc/clock"
+	"github.com/hsanjuan/go-dcc/railcom"
 )
 
 // GuessBuffer will be used by the dummy driver to
-// print the value of packets sent.
+// print the value of packets sent. Read it once the
+// drivers writing to it are done.
 var GuessBuffer bytes.Buffer
 
+// guessMux serializes writes to GuessBuffer by several drivers.
+var guessMux sync.Mutex
+
 // ByteOneTickMax configures how long a DCC encoded
 // 1 lasts. A tick lasting under this value will be guessed as 1.
 var ByteOneMax = 61 * time.Microsecond
@@ -19,22 +27,125 @@ var ByteOneMax = 61 * time.Microsecond
 // ByteOneTickMax will be guessed as 0.
 var ByteZeroMax = 9900 * time.Microsecond
 
+// DCCDummy is a driver which guesses the bits sent to it and
+// writes them to the GuessBuffer.
+//
+// It also simulates a decoder on a programming track, which holds
+// the values in CVs and acknowledges the service mode instructions
+// (direct, paged and register modes) that it receives. The same decoder
+// answers operations mode (POM) instructions sent to any locomotive
+// address with RailCom responses, which can be read with ReadCutout()
+// after a RailCom cutout.
+//
+// DCCDummy measures bits with its Time clock, which can be set to a
+// clock.Virtual to guess bits exactly, regardless of timer accuracy.
+//
+// DCCDummy is safe for concurrent use, i.e. by a dcc.Controller and a
+// test checking the simulated decoder.
 type DCCDummy struct {
+	// CVs holds the initial configuration variables of the simulated
+	// decoder. Once the driver is in use, use CV and SetCV instead.
+	CVs map[uint16]byte
+
+	// Time is the clock used to measure bits. It defaults to
+	// clock.System.
+	Time clock.Clock
+
+	mux      sync.Mutex
 	lasttick time.Time
+
+	// packet decoding
+	ones     int
+	inPacket bool
+	bitCount int
+	cur      byte
+	packet   []byte
+
+	// decoder simulation
+	service   bool
+	page      byte
+	pageValid bool
+	ack       bool
+	railCom   []byte
+}
+
+// Clock returns the Time clock, making DCCDummy a dcc.Clocked driver.
+func (d *DCCDummy) Clock() clock.Clock {
+	if d.Time == nil {
+		return clock.System
+	}
+	return d.Time
+}
+
+// CV returns the value of a configuration variable of the simulated
+// decoder.
+func (d *DCCDummy) CV(n uint16) byte {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	return d.CVs[n]
+}
+
+// SetCV sets the value of a configuration variable of the simulated
+// decoder.
+func (d *DCCDummy) SetCV(n uint16, value byte) {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	if d.CVs == nil {
+		d.CVs = make(map[uint16]byte)
+	}
+	d.CVs[n] = value
 }
 
 func (d *DCCDummy) Low() {
-	d.lasttick = time.Now()
+	now := d.Clock().Now()
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	d.lasttick = now
 }
 
 func (d *DCCDummy) High() {
-	dur := time.Since(d.lasttick)
+	now := d.Clock().Now()
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	d.guess(now.Sub(d.lasttick))
+}
+
+// SendWaveform guesses the bits from the duration of their low part. It
+// makes DCCDummy a dcc.WaveformDriver, so that guessing does not depend
+// on the accuracy of timers. Like real hardware, it takes as long as the
+// waveform lasts.
+func (d *DCCDummy) SendWaveform(halfBits []time.Duration) error {
+	var total time.Duration
+	d.mux.Lock()
+	for i := 0; i+1 < len(halfBits); i += 2 {
+		d.guess(halfBits[i])
+		total += halfBits[i] + halfBits[i+1]
+	}
+	d.mux.Unlock()
+
+	d.Clock().Sleep(total)
+	now := d.Clock().Now()
+	d.mux.Lock()
+	d.lasttick = now
+	d.mux.Unlock()
+	return nil
+}
+
+// guess writes the bit corresponding to the given duration to the
+// GuessBuffer and feeds it to the packet decoder. The caller must hold
+// d.mux.
+func (d *DCCDummy) guess(dur time.Duration) {
+	guessMux.Lock()
+	defer guessMux.Unlock()
 	if dur < ByteOneMax {
 		GuessBuffer.WriteString("1")
+		d.bit(1)
 	} else if dur < ByteZeroMax {
 		GuessBuffer.WriteString("0")
+		d.bit(0)
 	} else {
 		GuessBuffer.WriteString("\n")
+		d.resetDecoding()
 	}
 }
 
@@ -44,6 +155,225 @@ func (d *DCCDummy) TracksOff() {
 
 func (d *DCCDummy) TracksOn() {
 	fmt.Println("-> Dummy driver: Tracks on")
+	guessMux.Lock()
 	GuessBuffer.Reset()
-	d.lasttick = time.Now()
+	guessMux.Unlock()
+	now := d.Clock().Now()
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	d.lasttick = now
+}
+
+// CutoutStart does nothing: DCCDummy does not power any track.
+func (d *DCCDummy) CutoutStart() {}
+
+// CutoutEnd does nothing.
+func (d *DCCDummy) CutoutEnd() {}
+
+// ReadCutout returns the RailCom response of the simulated decoder
+// to the last packet, in channel 2. It makes DCCDummy a railcom.Source.
+func (d *DCCDummy) ReadCutout() ([]byte, []byte, error) {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	ch2 := d.railCom
+	d.railCom = nil
+	return nil, ch2, nil
+}
+
+// ResetAck discards any previous acknowledgement from the
+// simulated decoder.
+func (d *DCCDummy) ResetAck() {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	d.ack = false
+}
+
+// Ack returns true if the simulated decoder acknowledged a
+// service mode instruction since the last ResetAck().
+func (d *DCCDummy) Ack(window time.Duration) bool {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	return d.ack
+}
+
+func (d *DCCDummy) resetDecoding() {
+	d.ones = 0
+	d.inPacket = false
+	d.bitCount = 0
+	d.cur = 0
+	d.packet = nil
+}
+
+// bit feeds a guessed bit to the packet decoder.
+func (d *DCCDummy) bit(b byte) {
+	if !d.inPacket {
+		if b == 1 {
+			d.ones++
+			return
+		}
+		if d.ones >= 10 { // preamble and packet start bit
+			d.inPacket = true
+			d.bitCount = 0
+			d.cur = 0
+			d.packet = nil
+		}
+		d.ones = 0
+		return
+	}
+
+	if d.bitCount < 8 {
+		d.cur = d.cur<<1 | b
+		d.bitCount++
+		return
+	}
+
+	// Data start bit or packet end bit
+	d.packet = append(d.packet, d.cur)
+	d.bitCount = 0
+	d.cur = 0
+	if b == 1 {
+		d.process(d.packet)
+		d.resetDecoding()
+		d.ones = 1 // end bit may be part of the next preamble
+	}
+}
+
+// process handles a decoded packet, including the error
+// detection byte.
+func (d *DCCDummy) process(pkt []byte) {
+	if len(pkt) < 3 {
+		return
+	}
+	var ecc byte
+	for _, b := range pkt {
+		ecc = ecc ^ b
+	}
+	if ecc != 0 {
+		return
+	}
+	data := pkt[:len(pkt)-1]
+
+	if data[0] == 0 && data[1] == 0 && len(data) == 2 { // reset
+		d.service = true
+		return
+	}
+
+	if d.pom(data) {
+		d.service = false
+		return
+	}
+
+	if !d.service || data[0]&0xF0 != 0x70 {
+		d.service = false
+		return
+	}
+
+	switch len(data) {
+	case 3: // direct mode
+		cv := (uint16(data[0]&0x3)<<8 | uint16(data[1])) + 1
+		d.direct((data[0]>>2)&0x3, cv, data[2])
+	case 2: // paged and physical register mode
+		d.register(data[0]&0x8 != 0, data[0]&0x7+1, data[1])
+	}
+}
+
+// pom handles operations mode CV access instructions, preparing the
+// RailCom response. It returns false if data is not one of them.
+func (d *DCCDummy) pom(data []byte) bool {
+	var i int // instruction position
+	switch {
+	case data[0] >= 1 && data[0] <= 127: // short address
+		i = 1
+	case data[0] >= 0xC0 && data[0] <= 0xE7: // long address
+		i = 2
+	default:
+		return false
+	}
+	if len(data) != i+3 || data[i]&0xF0 != 0xE0 {
+		return false
+	}
+
+	cc := (data[i] >> 2) & 0x3
+	if cc == 0 { // reserved
+		d.railCom = railcom.Encode(railcom.NackDatagram{})
+		return true
+	}
+	cv := (uint16(data[i]&0x3)<<8 | uint16(data[i+1])) + 1
+	if cc != 0x1 { // writes
+		d.direct(cc, cv, data[i+2])
+	}
+	d.railCom = railcom.Encode(railcom.POMDatagram{Value: d.CVs[cv]})
+	return true
+}
+
+func (d *DCCDummy) direct(cc byte, cv uint16, value byte) {
+	if d.CVs == nil {
+		d.CVs = make(map[uint16]byte)
+	}
+
+	switch cc {
+	case 0x1: // verify byte
+		if d.CVs[cv] == value {
+			d.ack = true
+		}
+	case 0x3: // write byte
+		d.CVs[cv] = value
+		d.ack = true
+	case 0x2: // bit manipulation
+		bit := value & 0x7
+		set := (value>>3)&0x1 == 1
+		current := (d.CVs[cv]>>bit)&0x1 == 1
+		if value&0x10 == 0 { // verify
+			if current == set {
+				d.ack = true
+			}
+			return
+		}
+		if set {
+			d.CVs[cv] = d.CVs[cv] | (1 << bit)
+		} else {
+			d.CVs[cv] = d.CVs[cv] &^ (1 << bit)
+		}
+		d.ack = true
+	}
+}
+
+// register handles register (1-8) operations. Registers 1-4 are
+// mapped to the CVs in the current page, register 5 to CV29,
+// register 6 is the page register and registers 7 and 8 are
+// mapped to CV7 and CV8.
+func (d *DCCDummy) register(write bool, reg byte, value byte) {
+	if reg == 6 {
+		if write {
+			d.page = value
+			d.pageValid = true
+			d.ack = true
+		} else if d.page == value {
+			d.ack = true
+		}
+		return
+	}
+
+	var cv uint16
+	switch reg {
+	case 1, 2, 3, 4:
+		page := uint16(1)
+		if d.pageValid {
+			page = uint16(d.page)
+			if page == 0 {
+				page = 256
+			}
+		}
+		cv = (page-1)*4 + uint16(reg)
+	case 5:
+		cv = 29
+	default:
+		cv = uint16(reg)
+	}
+
+	if write {
+		d.direct(0x3, cv, value)
+	} else {
+		d.direct(0x1, cv, value)
+	}
 }
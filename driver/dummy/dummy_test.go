@@ -3,12 +3,17 @@ package dummy
 import (
 	"testing"
 	"time"
+
+	"github.com/hsanjuan/go-dcc/clock"
+	"github.com/hsanjuan/go-dcc/railcom"
 )
 
 func TestGuessBuffer(t *testing.T) {
-	d := DCCDummy{}
+	clk := &clock.Virtual{}
+	d := DCCDummy{Time: clk}
 	d.TracksOn()
 	d.Low()
+	clk.Advance(58 * time.Microsecond)
 	d.High()
 	d.Low()
 	d.High()
@@ -18,17 +23,166 @@ func TestGuessBuffer(t *testing.T) {
 	d.TracksOff()
 	d.TracksOn()
 	d.Low()
-	time.Sleep(5000 * time.Microsecond)
+	clk.Advance(5000 * time.Microsecond)
 	d.High()
-	time.Sleep(5000 * time.Microsecond)
+	clk.Advance(5000 * time.Microsecond)
 	d.Low()
-	time.Sleep(5000 * time.Microsecond)
+	clk.Advance(5000 * time.Microsecond)
 	d.High()
 	d.Low()
-	time.Sleep(time.Second)
+	clk.Advance(time.Second)
 	d.High()
 
 	if GuessBuffer.String() != "00\n" {
 		t.Error("it should guess 0")
 	}
 }
+
+func TestSystemClock(t *testing.T) {
+	d := DCCDummy{}
+	if d.Clock() != clock.System {
+		t.Error("should default to the system clock")
+	}
+}
+
+func TestSendWaveform(t *testing.T) {
+	d := DCCDummy{}
+	d.TracksOn()
+	one := 58 * time.Microsecond
+	zero := 100 * time.Microsecond
+	err := d.SendWaveform([]time.Duration{one, one, zero, zero, zero, zero, one, one})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if GuessBuffer.String() != "1001" {
+		t.Error("bad guess: ", GuessBuffer.String())
+	}
+}
+
+func TestDecoderSimulation(t *testing.T) {
+	d := DCCDummy{CVs: map[uint16]byte{1: 3}}
+	withECC := func(data ...byte) []byte {
+		var ecc byte
+		for _, b := range data {
+			ecc = ecc ^ b
+		}
+		return append(data, ecc)
+	}
+
+	// Not in service mode
+	d.process(withECC(0x74, 0x00, 0x03))
+	if d.Ack(0) {
+		t.Error("should not ack outside service mode")
+	}
+
+	d.process(withECC(0x00, 0x00)) // reset
+	d.process(withECC(0x74, 0x00, 0x03))
+	if !d.Ack(0) {
+		t.Error("should ack a correct verify byte")
+	}
+
+	d.ResetAck()
+	d.process(withECC(0x74, 0x00, 0x04))
+	if d.Ack(0) {
+		t.Error("should not ack a wrong verify byte")
+	}
+
+	d.process(withECC(0x7C, 0x1C, 0x06)) // write CV29
+	if d.CV(29) != 6 {
+		t.Error("should have written CV29")
+	}
+
+	d.ResetAck()
+	d.process(withECC(0x78, 0x1C, 0xEA)) // verify CV29 bit 2 set
+	if !d.Ack(0) {
+		t.Error("should ack a correct verify bit")
+	}
+
+	d.process(withECC(0x7D, 0x02)) // page 2
+	d.process(withECC(0x78, 0x09)) // write register 1
+	if d.CV(5) != 9 {
+		t.Error("should have written CV5 using paged mode")
+	}
+
+	d.ResetAck()
+	d.process(withECC(0x74, 0x00, 0x03)[:3]) // bad ecc
+	if d.Ack(0) {
+		t.Error("should ignore packets with a bad error detection byte")
+	}
+}
+
+func TestBitDecoding(t *testing.T) {
+	d := DCCDummy{CVs: map[uint16]byte{}}
+	send := func(bits string) {
+		for _, b := range bits {
+			d.bit(byte(b - '0'))
+		}
+	}
+	// Reset and direct write CV1=3 with preambles
+	send("11111111111111111111" + "0" + "00000000" + "0" + "00000000" + "0" + "00000000" + "1")
+	send("11111111111111111111" + "0" + "01111100" + "0" + "00000000" + "0" + "00000011" + "0" + "01111111" + "1")
+	if d.CV(1) != 3 {
+		t.Error("should have decoded the packets from bits")
+	}
+}
+
+func TestPOM(t *testing.T) {
+	d := DCCDummy{CVs: map[uint16]byte{8: 151}}
+	withECC := func(data ...byte) []byte {
+		var ecc byte
+		for _, b := range data {
+			ecc = ecc ^ b
+		}
+		return append(data, ecc)
+	}
+	response := func() string {
+		_, ch2, _ := d.ReadCutout()
+		dgs, err := railcom.Decode(ch2)
+		if err != nil || len(dgs) != 1 {
+			t.Fatal("bad response: ", dgs, err)
+		}
+		return dgs[0].String()
+	}
+
+	d.process(withECC(0x03, 0xE4, 0x07, 0x00)) // read CV8, short address
+	if r := response(); r != "pom 151" {
+		t.Error("bad read response: ", r)
+	}
+
+	d.process(withECC(0xC7, 0xD0, 0xEC, 0x02, 0x14)) // write CV3 = 20, long address
+	if d.CV(3) != 20 {
+		t.Error("should have written CV3")
+	}
+	if r := response(); r != "pom 20" {
+		t.Error("bad write response: ", r)
+	}
+
+	d.process(withECC(0x03, 0xE0, 0x07, 0x00)) // reserved
+	if r := response(); r != "nack" {
+		t.Error("should nack reserved instructions: ", r)
+	}
+
+	if _, ch2, _ := d.ReadCutout(); ch2 != nil {
+		t.Error("responses should only be read once")
+	}
+}
+
+func TestConcurrent(t *testing.T) {
+	d := &DCCDummy{Time: &clock.Virtual{}}
+	one := 58 * time.Microsecond
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			d.SendWaveform([]time.Duration{one, one})
+			d.ReadCutout()
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		d.SetCV(1, byte(i))
+		d.CV(1)
+		d.ResetAck()
+		d.Ack(0)
+	}
+	<-done
+}
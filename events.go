@@ -0,0 +1,190 @@
+package dcc
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+// EventBuffer specifies how many events can queue for a
+// subscriber registered with SubscribeFunc before new
+// events are dropped.
+var EventBuffer = 64
+
+// EventType identifies the kind of an Event.
+type EventType int
+
+// EventType values.
+const (
+	// EventLocoAdded is sent when a Locomotive is added to the
+	// Controller.
+	EventLocoAdded EventType = iota
+	// EventLocoRemoved is sent when a Locomotive is removed from
+	// the Controller.
+	EventLocoRemoved
+	// EventLocoChanged is sent when the properties of a Locomotive
+	// in the Controller change through its methods (Update, the
+	// setters, EmergencyStop or Apply), whether the Controller is
+	// running or not.
+	EventLocoChanged
+	// EventTrackState is sent when the state of the tracks
+	// changes, i.e. when the Controller starts or stops or
+	// during an emergency stop.
+	EventTrackState
+	// EventCommandSent is sent once a command (see Command and
+	// Submit) has been sent to the tracks as many times as
+	// requested.
+	EventCommandSent
+	// EventError is sent for the errors that happen while the
+	// Controller sends packets (see SetErrorHandler).
+	EventError
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventLocoAdded:
+		return "loco added"
+	case EventLocoRemoved:
+		return "loco removed"
+	case EventLocoChanged:
+		return "loco changed"
+	case EventTrackState:
+		return "track state"
+	case EventCommandSent:
+		return "command sent"
+	case EventError:
+		return "error"
+	default:
+		return fmt.Sprintf("EventType(%d)", int(t))
+	}
+}
+
+// Event describes something that happened in a Controller. Only the
+// fields relevant to its Type are set: Loco and State for locomotive
+// events, Track for EventTrackState, Packet for EventCommandSent and
+// Err for EventError.
+type Event struct {
+	Type   EventType
+	Loco   *Locomotive
+	State  LocoState // snapshot of the Locomotive when the event happened
+	Track  TrackState
+	Packet *Packet
+	Err    error
+}
+
+// String returns a human-readable description of the event, like
+// "loco added: abc" or "track state: on".
+func (e Event) String() string {
+	switch e.Type {
+	case EventLocoAdded, EventLocoRemoved, EventLocoChanged:
+		return fmt.Sprintf("%s: %s", e.Type, e.Loco.Name)
+	case EventTrackState:
+		return fmt.Sprintf("%s: %s", e.Type, e.Track)
+	case EventCommandSent:
+		return fmt.Sprintf("%s: %s", e.Type, e.Packet.Describe())
+	case EventError:
+		return fmt.Sprintf("%s: %s", e.Type, e.Err)
+	default:
+		return e.Type.String()
+	}
+}
+
+// Subscription represents a subscriber to the events of a Controller.
+type Subscription struct {
+	c       *Controller
+	ch      chan<- Event
+	dropped atomic.Uint64
+	done    chan struct{}
+	once    sync.Once
+}
+
+// Unsubscribe stops delivering events to the subscriber. Callbacks
+// registered with SubscribeFunc are not called afterwards, except for
+// any call in progress. Channels are not closed.
+func (s *Subscription) Unsubscribe() {
+	s.once.Do(func() {
+		s.c.subMux.Lock()
+		delete(s.c.subs, s)
+		s.c.subMux.Unlock()
+		close(s.done)
+	})
+}
+
+// Dropped returns the number of events that were dropped because the
+// subscriber was not keeping up.
+func (s *Subscription) Dropped() uint64 {
+	return s.dropped.Load()
+}
+
+// deliver passes an event to the subscriber without blocking.
+func (s *Subscription) deliver(e Event) {
+	select {
+	case s.ch <- e:
+	default:
+		s.dropped.Add(1)
+	}
+}
+
+// Subscribe registers a channel to receive the Controller's events.
+// Events are never waited for: when the channel is not ready to
+// receive, the event is dropped (see Subscription.Dropped), so use a
+// buffered channel and read from it continuously.
+func (c *Controller) Subscribe(ch chan<- Event) *Subscription {
+	s := &Subscription{
+		c:    c,
+		ch:   ch,
+		done: make(chan struct{}),
+	}
+	c.subMux.Lock()
+	defer c.subMux.Unlock()
+	if c.subs == nil {
+		c.subs = make(map[*Subscription]struct{})
+	}
+	c.subs[s] = struct{}{}
+	return s
+}
+
+// SubscribeFunc registers a function which is called with every
+// event, in order, from a separate goroutine. Up to EventBuffer events
+// queue while the function runs, and further events are dropped.
+func (c *Controller) SubscribeFunc(f func(e Event)) *Subscription {
+	ch := make(chan Event, EventBuffer)
+	s := c.Subscribe(ch)
+	go func() {
+		for {
+			select {
+			case <-s.done:
+				return
+			case e := <-ch:
+				select {
+				case <-s.done:
+					return
+				default:
+					f(e)
+				}
+			}
+		}
+	}()
+	return s
+}
+
+// emit delivers an event to all subscribers.
+func (c *Controller) emit(e Event) {
+	c.subMux.Lock()
+	defer c.subMux.Unlock()
+	for s := range c.subs {
+		s.deliver(e)
+	}
+}
+
+// emitLoco delivers a locomotive event with a snapshot of the
+// Locomotive.
+func (c *Controller) emitLoco(t EventType, l *Locomotive) {
+	c.subMux.Lock()
+	n := len(c.subs)
+	c.subMux.Unlock()
+	if n == 0 {
+		return
+	}
+	c.emit(Event{Type: t, Loco: l, State: l.Snapshot()})
+}
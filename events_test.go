@@ -0,0 +1,140 @@
+package dcc
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/hsanjuan/go-dcc/clock"
+	"github.com/hsanjuan/go-dcc/driver/dummy"
+)
+
+// waitEvent reads events until one of the given type arrives.
+func waitEvent(t *testing.T, ch <-chan Event, typ EventType) Event {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case e := <-ch:
+			if e.Type == typ {
+				return e
+			}
+		case <-timeout:
+			t.Fatalf("timed out waiting for %s event", typ)
+		}
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	must := mustBuild(t)
+	c := NewController(&dummy.DCCDummy{Time: &clock.Virtual{}})
+	ch := make(chan Event, 1000)
+	sub := c.Subscribe(ch)
+	defer sub.Unsubscribe()
+
+	l := &Locomotive{Name: "abc", Address: 3, Speed: 4}
+	c.AddLoco(l)
+	if e := waitEvent(t, ch, EventLocoAdded); e.Loco != l || e.State.Speed != 4 {
+		t.Error("bad loco added event: ", e)
+	}
+
+	// Changes are sent while stopped too.
+	if err := l.SetFunction(1, true); err != nil {
+		t.Fatal(err)
+	}
+	if e := waitEvent(t, ch, EventLocoChanged); e.Loco != l || !e.State.F1 {
+		t.Error("bad loco changed event: ", e)
+	}
+
+	c.Start()
+	if e := waitEvent(t, ch, EventTrackState); e.Track != TrackOn {
+		t.Error("tracks should be on: ", e)
+	}
+
+	if err := l.SetSpeed(8); err != nil {
+		t.Fatal(err)
+	}
+	if e := waitEvent(t, ch, EventLocoChanged); e.Loco != l || e.State.Speed != 8 {
+		t.Error("bad loco changed event: ", e)
+	}
+
+	p := must(NewFunctionGroupOnePacket(Address{Number: 10}, true, false, false, false, false))
+	if err := c.Command(p); err != nil {
+		t.Fatal(err)
+	}
+	if e := waitEvent(t, ch, EventCommandSent); e.Packet != p {
+		t.Error("bad command sent event: ", e)
+	}
+
+	c.EmergencyStop()
+	if e := waitEvent(t, ch, EventTrackState); e.Track != TrackEStop {
+		t.Error("tracks should be in emergency stop: ", e)
+	}
+	c.ReleaseEmergencyStop()
+	if e := waitEvent(t, ch, EventTrackState); e.Track != TrackOn {
+		t.Error("tracks should be on: ", e)
+	}
+
+	c.Stop()
+	if e := waitEvent(t, ch, EventTrackState); e.Track != TrackOff {
+		t.Error("tracks should be off: ", e)
+	}
+
+	c.RmLoco(l)
+	if e := waitEvent(t, ch, EventLocoRemoved); e.String() != "loco removed: abc" {
+		t.Error("bad loco removed event: ", e)
+	}
+	c.RmLoco(l)
+	l.SetSpeed(1)
+	select {
+	case e := <-ch:
+		t.Error("removing an unknown loco should not send events: ", e)
+	default:
+	}
+}
+
+func TestSubscribeDropped(t *testing.T) {
+	c := NewController(&dummy.DCCDummy{})
+	ch := make(chan Event, 1)
+	sub := c.Subscribe(ch)
+	c.AddLoco(&Locomotive{Name: "abc", Address: 3})
+	c.AddLoco(&Locomotive{Name: "def", Address: 4})
+	if sub.Dropped() != 1 {
+		t.Error("one event should have been dropped: ", sub.Dropped())
+	}
+	if e := <-ch; e.Loco.Name != "abc" {
+		t.Error("should have received the first event: ", e)
+	}
+
+	sub.Unsubscribe()
+	sub.Unsubscribe()
+	c.AddLoco(&Locomotive{Name: "ghi", Address: 5})
+	select {
+	case e := <-ch:
+		t.Error("should not receive events after unsubscribing: ", e)
+	default:
+	}
+}
+
+func TestSubscribeFunc(t *testing.T) {
+	c := NewController(&dummy.DCCDummy{Time: &clock.Virtual{}})
+	c.SetErrorHandler(func(err error) {})
+	ch := make(chan Event, 1000)
+	sub := c.SubscribeFunc(func(e Event) { ch <- e })
+
+	c.AddLoco(&Locomotive{Name: "bad", Address: 200})
+	c.Start()
+	defer c.Stop()
+	if e := waitEvent(t, ch, EventError); !errors.Is(e.Err, ErrBadAddress) {
+		t.Error("should have received the error: ", e)
+	}
+
+	sub.Unsubscribe()
+	c.AddLoco(&Locomotive{Name: "abc", Address: 3})
+	time.Sleep(10 * time.Millisecond)
+	for len(ch) > 0 {
+		if e := <-ch; e.Type == EventLocoAdded {
+			t.Error("should not receive events after unsubscribing: ", e)
+		}
+	}
+}
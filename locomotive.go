@@ -1,7 +1,10 @@
 package dcc
 
 import (
+	"encoding/json"
 	"fmt"
+	"sort"
+	"strings"
 	"sync"
 )
 
@@ -11,33 +14,73 @@ const (
 	Forward  Direction = 1
 )
 
+// MaxFunction is the highest function number (F68) that can be
+// controlled on a Locomotive.
+const MaxFunction = 68
+
 // Direction represents the locomotive direction and can be
 // Forward or Backward.
 type Direction byte
 
+// Reverse returns the opposite direction.
+func (d Direction) Reverse() Direction {
+	if d == Forward {
+		return Backward
+	}
+	return Forward
+}
+
 // Locomotive represents a DCC device, usually a locomotive.
 // Locomotives are represented by their name and address and
 // include certain properties like speed, direction or FL.
-// Each locomotive produces two packets: one speed and direction
+// Each locomotive produces at least two packets: one speed and direction
 // packet and one Function Group One packet.
+//
+// Address is interpreted as a short (7-bit) address unless
+// LongAddress is set, in which case the extended 14-bit addressing
+// is used. Speed is a speed step in the mode given by SpeedSteps.
+//
+// Functions holds the state of F5 to F68, indexed by function number.
+// Packets for a function group are only sent when the map holds any
+// function in that group. F13-F28 are sent with the feature expansion
+// instructions and F29-F68 as binary states. Use SetFunction to modify
+// functions on a Locomotive that is in use.
+//
+// The properties should not be modified directly once the Locomotive
+// has been added to a Controller, as the Controller reads them
+// concurrently. Use Update or the setters (SetSpeed, SetDirection,
+// SetFunction) instead, and Snapshot to read them.
 type Locomotive struct {
-	Name      string    `json:"name"`
-	Address   uint8     `json:"address"`
-	Speed     uint8     `json:"speed"`
-	Direction Direction `json:"direction"`
-	Fl        bool      `json:"fl"`
-	F1        bool      `json:"f1"`
-	F2        bool      `json:"f2"`
-	F3        bool      `json:"f3"`
-	F4        bool      `json:"f4"`
+	Name        string     `json:"name"`
+	Address     uint16     `json:"address"`
+	LongAddress bool       `json:"long_address"`
+	Speed       uint8      `json:"speed"`
+	SpeedSteps  SpeedSteps `json:"speed_steps"`
+	Direction   Direction  `json:"direction"`
+	Fl          bool       `json:"fl"`
+	F1          bool       `json:"f1"`
+	F2          bool       `json:"f2"`
+	F3          bool       `json:"f3"`
+	F4          bool       `json:"f4"`
+
+	Functions map[uint8]bool `json:"functions,omitempty"`
 
 	mux sync.Mutex
 
 	speedPacket *Packet
 	flPacket    *Packet
+	fnPackets   []*Packet
+	failed      bool
+	eStop       bool
+
+	// onChange is called after the properties change through the
+	// Locomotive's methods. The Controller sets it in AddLoco.
+	onChange func(l *Locomotive)
 }
 
 func (l *Locomotive) String() string {
+	l.mux.Lock()
+	defer l.mux.Unlock()
 	var dir, fl, f1, f2, f3, f4 string = "", "off", "off", "off", "off", "off"
 	if l.Direction == Forward {
 		dir = ">"
@@ -59,9 +102,9 @@ func (l *Locomotive) String() string {
 	if l.F4 {
 		f4 = "on"
 	}
-	return fmt.Sprintf("%s:%d |%d%s| |%s| |%s|%s|%s|%s|",
+	str := fmt.Sprintf("%s:%s |%d%s| |%s| |%s|%s|%s|%s|",
 		l.Name,
-		l.Address,
+		l.address(),
 		l.Speed,
 		dir,
 		fl,
@@ -69,34 +112,402 @@ func (l *Locomotive) String() string {
 		f2,
 		f3,
 		f4)
+
+	var fns []string
+	for _, n := range l.functionNumbers() {
+		if l.Functions[n] {
+			fns = append(fns, fmt.Sprintf("F%d", n))
+		}
+	}
+	if len(fns) > 0 {
+		str += " |" + strings.Join(fns, "|") + "|"
+	}
+	return str
+}
+
+// functionNumbers returns the sorted function numbers in the
+// Functions map.
+func (l *Locomotive) functionNumbers() []uint8 {
+	nums := make([]uint8, 0, len(l.Functions))
+	for n := range l.Functions {
+		nums = append(nums, n)
+	}
+	sort.Slice(nums, func(i, j int) bool { return nums[i] < nums[j] })
+	return nums
 }
 
-func (l *Locomotive) sendPackets(d Driver) {
+// hasFunctions returns true when the Functions map holds any function
+// between from and to (both included).
+func (l *Locomotive) hasFunctions(from, to uint8) bool {
+	for n := range l.Functions {
+		if n >= from && n <= to {
+			return true
+		}
+	}
+	return false
+}
+
+// function returns the state of Fn.
+func (l *Locomotive) function(n uint8) bool {
+	switch n {
+	case 0:
+		return l.Fl
+	case 1:
+		return l.F1
+	case 2:
+		return l.F2
+	case 3:
+		return l.F3
+	case 4:
+		return l.F4
+	default:
+		return l.Functions[n]
+	}
+}
+
+// Function returns the state of function Fn. F0 corresponds to FL.
+func (l *Locomotive) Function(n uint8) bool {
 	l.mux.Lock()
-	{
+	defer l.mux.Unlock()
+	return l.function(n)
+}
+
+// SetFunction sets the state of function Fn, where F0 corresponds to FL
+// (see Update). It returns ErrBadValue for functions above MaxFunction.
+func (l *Locomotive) SetFunction(n uint8, on bool) error {
+	if n > MaxFunction {
+		return fmt.Errorf("%w: function F%d (max F%d)", ErrBadValue, n, MaxFunction)
+	}
+	return l.Update(func(s *LocoState) {
+		switch n {
+		case 0:
+			s.Fl = on
+		case 1:
+			s.F1 = on
+		case 2:
+			s.F2 = on
+		case 3:
+			s.F3 = on
+		case 4:
+			s.F4 = on
+		default:
+			if s.Functions == nil {
+				s.Functions = make(map[uint8]bool)
+			}
+			s.Functions[n] = on
+		}
+	})
+}
+
+// setOnChange sets the function called by changed.
+func (l *Locomotive) setOnChange(f func(l *Locomotive)) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	l.onChange = f
+}
+
+// changed calls the onChange function, if any. It must be called
+// without holding l.mux.
+func (l *Locomotive) changed() {
+	l.mux.Lock()
+	f := l.onChange
+	l.mux.Unlock()
+	if f != nil {
+		f(l)
+	}
+}
+
+// functionPackets builds the packets for functions above F4.
+func (l *Locomotive) functionPackets() ([]*Packet, error) {
+	pkts := []*Packet{}
+	addr := l.address()
+	add := func(p *Packet, err error) error {
+		if err != nil {
+			return err
+		}
+		pkts = append(pkts, p)
+		return nil
+	}
+
+	if l.hasFunctions(5, 8) {
+		err := add(NewFunctionGroupTwoPacket(addr,
+			l.function(5), l.function(6), l.function(7), l.function(8)))
+		if err != nil {
+			return nil, err
+		}
+	}
+	if l.hasFunctions(9, 12) {
+		err := add(NewFunctionGroupThreePacket(addr,
+			l.function(9), l.function(10), l.function(11), l.function(12)))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	states := func(first uint8) byte {
+		var b byte
+		for i := uint8(0); i < 8; i++ {
+			if l.function(first + i) {
+				b = b | (1 << i)
+			}
+		}
+		return b
+	}
+	if l.hasFunctions(13, 20) {
+		if err := add(NewFunctionsF13F20Packet(addr, states(13))); err != nil {
+			return nil, err
+		}
+	}
+	if l.hasFunctions(21, 28) {
+		if err := add(NewFunctionsF21F28Packet(addr, states(21))); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, n := range l.functionNumbers() {
+		if n >= 29 && n <= MaxFunction {
+			err := add(NewBinaryStatePacket(addr, uint16(n), l.Functions[n]))
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return pkts, nil
+}
 
-		if l.speedPacket == nil {
-			l.speedPacket = NewSpeedAndDirectionPacket(d,
-				l.Address, l.Speed, l.Direction)
+func (l *Locomotive) address() Address {
+	return Address{
+		Number: l.Address,
+		Long:   l.LongAddress,
+	}
+}
+
+func (l *Locomotive) speed() Speed {
+	return Speed{
+		Step:  l.Speed,
+		Steps: l.SpeedSteps,
+		EStop: l.eStop,
+	}
+}
+
+// packets returns the packets which should be sent to the tracks to
+// reflect the Locomotive's properties, building them if necessary.
+// When they cannot be built (i.e. the address is out of range), the
+// error is returned once, and no packets are returned until Apply is
+// called.
+func (l *Locomotive) packets() ([]*Packet, error) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	if l.failed {
+		return nil, nil
+	}
+
+	pkts, err := l.buildPackets()
+	if err != nil {
+		l.failed = true
+		return nil, fmt.Errorf("locomotive %s: %w", l.Name, err)
+	}
+	return pkts, nil
+}
+
+func (l *Locomotive) buildPackets() ([]*Packet, error) {
+	var err error
+	if l.speedPacket == nil {
+		l.speedPacket, err = NewSpeedDirectionAndLightPacket(
+			l.address(), l.speed(), l.Direction, l.Fl)
+		if err != nil {
+			return nil, err
 		}
-		if l.flPacket == nil {
-			l.flPacket = NewFunctionGroupOnePacket(d,
-				l.Address, l.Fl, l.F1, l.F2, l.F3, l.F4)
+	}
+	if l.flPacket == nil {
+		l.flPacket, err = NewFunctionGroupOnePacket(
+			l.address(), l.Fl, l.F1, l.F2, l.F3, l.F4)
+		if err != nil {
+			return nil, err
 		}
-		l.speedPacket.Send()
-		l.flPacket.Send()
 	}
+	if l.fnPackets == nil {
+		l.fnPackets, err = l.functionPackets()
+		if err != nil {
+			return nil, err
+		}
+	}
+	pkts := make([]*Packet, 0, 2+len(l.fnPackets))
+	pkts = append(pkts, l.speedPacket, l.flPacket)
+	return append(pkts, l.fnPackets...), nil
+}
+
+// EmergencyStop sets the Locomotive's speed to 0 and makes its packets
+// ask the decoder to stop immediately, cutting the power to the motor.
+// The emergency stop lasts until Apply is called or the speed is
+// changed with Update.
+func (l *Locomotive) EmergencyStop() {
+	l.mux.Lock()
+	l.Speed = 0
+	l.eStop = true
+	l.speedPacket = nil
 	l.mux.Unlock()
+	l.changed()
+}
+
+// LocoState holds the properties of a Locomotive which change while it
+// runs. Functions holds F5 to F68, like Locomotive.Functions. EStop is
+// true during an emergency stop of the Locomotive (see EmergencyStop)
+// and cannot be changed with Update.
+type LocoState struct {
+	Speed      uint8
+	SpeedSteps SpeedSteps
+	Direction  Direction
+	Fl         bool
+	F1         bool
+	F2         bool
+	F3         bool
+	F4         bool
+	Functions  map[uint8]bool
+	EStop      bool
+}
+
+// Function returns the state of function Fn. F0 corresponds to FL.
+func (s LocoState) Function(n uint8) bool {
+	switch n {
+	case 0:
+		return s.Fl
+	case 1:
+		return s.F1
+	case 2:
+		return s.F2
+	case 3:
+		return s.F3
+	case 4:
+		return s.F4
+	default:
+		return s.Functions[n]
+	}
+}
+
+func copyFunctions(fns map[uint8]bool) map[uint8]bool {
+	if fns == nil {
+		return nil
+	}
+	cp := make(map[uint8]bool, len(fns))
+	for n, on := range fns {
+		cp[n] = on
+	}
+	return cp
+}
+
+func (l *Locomotive) state() LocoState {
+	return LocoState{
+		Speed:      l.Speed,
+		SpeedSteps: l.SpeedSteps,
+		Direction:  l.Direction,
+		Fl:         l.Fl,
+		F1:         l.F1,
+		F2:         l.F2,
+		F3:         l.F3,
+		F4:         l.F4,
+		Functions:  copyFunctions(l.Functions),
+		EStop:      l.eStop,
+	}
+}
+
+func (l *Locomotive) setState(s LocoState) {
+	l.Speed = s.Speed
+	l.SpeedSteps = s.SpeedSteps
+	l.Direction = s.Direction
+	l.Fl = s.Fl
+	l.F1 = s.F1
+	l.F2 = s.F2
+	l.F3 = s.F3
+	l.F4 = s.F4
+	l.Functions = s.Functions
+}
+
+// Snapshot returns a copy of the Locomotive's current state. It is safe
+// to call while the Locomotive is in use by a Controller.
+func (l *Locomotive) Snapshot() LocoState {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	return l.state()
+}
+
+// Update modifies the Locomotive's state with the given function and
+// builds the new packets for it, all at once, so that the Controller
+// never sends packets with partial changes. Changing the speed ends any
+// emergency stop. When the packets cannot be built, the Locomotive is
+// left untouched and the error is returned.
+func (l *Locomotive) Update(f func(s *LocoState)) error {
+	if err := l.update(f); err != nil {
+		return err
+	}
+	l.changed()
+	return nil
+}
+
+func (l *Locomotive) update(f func(s *LocoState)) error {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	old := l.state()
+	s := l.state()
+	f(&s)
+	s.Functions = copyFunctions(s.Functions)
+	for n := range s.Functions {
+		if n > MaxFunction {
+			delete(s.Functions, n)
+		}
+	}
+
+	speedPacket, flPacket, fnPackets := l.speedPacket, l.flPacket, l.fnPackets
+	eStop := l.eStop
+	l.setState(s)
+	l.speedPacket, l.flPacket, l.fnPackets = nil, nil, nil
+	if s.Speed != old.Speed {
+		l.eStop = false
+	}
+	if _, err := l.buildPackets(); err != nil {
+		l.setState(old)
+		l.speedPacket, l.flPacket, l.fnPackets = speedPacket, flPacket, fnPackets
+		l.eStop = eStop
+		return fmt.Errorf("locomotive %s: %w", l.Name, err)
+	}
+	l.failed = false
+	return nil
+}
+
+// SetSpeed sets the Locomotive's speed step (see Update).
+func (l *Locomotive) SetSpeed(speed uint8) error {
+	return l.Update(func(s *LocoState) { s.Speed = speed })
+}
+
+// SetDirection sets the Locomotive's direction (see Update).
+func (l *Locomotive) SetDirection(dir Direction) error {
+	return l.Update(func(s *LocoState) { s.Direction = dir })
+}
+
+// MarshalJSON encodes the Locomotive's properties. Unlike encoding
+// the fields directly, it is safe to call while the Locomotive is in
+// use by a Controller.
+func (l *Locomotive) MarshalJSON() ([]byte, error) {
+	type plain Locomotive // without MarshalJSON
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	return json.Marshal((*plain)(l))
 }
 
 // Apply makes any changes to the Locomotive's properties
 // to be reflected in the packets generated for it and,
 // therefore, alter the behaviour of the device on the tracks.
+// For Locomotives in use by a Controller, use Update instead.
 func (l *Locomotive) Apply() {
 	l.mux.Lock()
 	{
 		l.speedPacket = nil
 		l.flPacket = nil
+		l.fnPackets = nil
+		l.failed = false
+		l.eStop = false
 	}
 	l.mux.Unlock()
+	l.changed()
 }
@@ -1,16 +1,17 @@
 package dcc
 
 import (
+	"encoding/json"
+	"errors"
+	"sync"
 	"testing"
-
-	"github.com/hsanjuan/go-dcc/driver/dummy"
 )
 
 func TestApply(t *testing.T) {
 	l := &Locomotive{
 		Name:        "loco",
 		Address:     3,
-		speedPacket: NewBroadcastIdlePacket(&dummy.DCCDummy{}),
+		speedPacket: NewBroadcastIdlePacket(),
 	}
 	l.Apply()
 	if l.speedPacket != nil {
@@ -18,6 +19,109 @@ func TestApply(t *testing.T) {
 	}
 }
 
+func TestSpeedSteps(t *testing.T) {
+	must := mustBuild(t)
+	l := &Locomotive{
+		Name:       "loco",
+		Address:    3,
+		Speed:      100,
+		SpeedSteps: SpeedSteps128,
+		Direction:  Forward,
+	}
+	l.packets()
+	expected := must(NewAdvancedSpeedPacket(Address{Number: 3}, Speed{Step: 100}, Forward))
+	if l.speedPacket.String() != expected.String() {
+		t.Error("should have used the 128 speed step instruction")
+	}
+
+	l.SpeedSteps = SpeedSteps28
+	l.Apply()
+	l.packets()
+	expected = must(NewSpeedAndDirectionPacket(Address{Number: 3}, Speed{Step: 100}, Forward))
+	if l.speedPacket.String() != expected.String() {
+		t.Error("should have used the baseline speed instruction")
+	}
+
+	l.SpeedSteps = SpeedSteps14
+	l.Speed = 0
+	l.Fl = true
+	l.Apply()
+	l.packets()
+	if l.speedPacket.data[0] != 0x70 { // 0b01110000
+		t.Errorf("should have set FL in 14-step mode: %08b", l.speedPacket.data[0])
+	}
+}
+
+func TestPacketsError(t *testing.T) {
+	l := &Locomotive{Name: "loco", Address: 128}
+	if _, err := l.packets(); err == nil {
+		t.Fatal("should fail with a bad address")
+	}
+	if pkts, err := l.packets(); pkts != nil || err != nil {
+		t.Error("should not return the error again until Apply")
+	}
+	l.LongAddress = true
+	l.Apply()
+	if pkts, err := l.packets(); err != nil || len(pkts) != 2 {
+		t.Error("should build packets after Apply: ", err)
+	}
+}
+
+func TestSetFunction(t *testing.T) {
+	l := &Locomotive{
+		Name:    "loco",
+		Address: 3,
+	}
+	l.packets()
+	if len(l.fnPackets) != 0 {
+		t.Fatal("should not send extra function packets")
+	}
+
+	for _, fn := range []struct {
+		n  uint8
+		on bool
+	}{{0, true}, {6, true}, {13, false}, {30, true}} {
+		if err := l.SetFunction(fn.n, fn.on); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := l.SetFunction(MaxFunction+1, true); !errors.Is(err, ErrBadValue) {
+		t.Error("should fail setting functions over MaxFunction: ", err)
+	}
+	if !l.Fl || !l.Function(0) || !l.Function(6) || l.Function(13) {
+		t.Error("functions not set correctly")
+	}
+	if _, ok := l.Functions[MaxFunction+1]; ok {
+		t.Error("should ignore functions over MaxFunction")
+	}
+
+	bad := &Locomotive{Name: "bad", Address: 200}
+	if err := bad.SetFunction(1, true); !errors.Is(err, ErrBadAddress) || bad.F1 {
+		t.Error("should fail with a bad address: ", err)
+	}
+
+	l.packets()
+	if l.flPacket.data[0] != 0x90 { // 0b10010000
+		t.Errorf("bad function group one packet: %08b", l.flPacket.data)
+	}
+	if len(l.fnPackets) != 3 {
+		t.Fatal("expected F5-F8, F13-F20 and F30 packets")
+	}
+	if l.fnPackets[0].data[0] != 0xB2 { // 0b10110010
+		t.Errorf("bad function group two packet: %08b", l.fnPackets[0].data)
+	}
+	if l.fnPackets[1].data[0] != 0xDE || l.fnPackets[1].data[1] != 0 {
+		t.Errorf("bad F13-F20 packet: %08b", l.fnPackets[1].data)
+	}
+	if l.fnPackets[2].data[0] != 0xDD || l.fnPackets[2].data[1] != 0x9E {
+		t.Errorf("bad binary state packet: %08b", l.fnPackets[2].data)
+	}
+
+	if l.String() != "loco:3 |0<| |on| |off|off|off|off| |F6|F30|" {
+		t.Error("bad string: ", l.String())
+	}
+}
+
 func TestString(t *testing.T) {
 	l := &Locomotive{
 		Name:      "loco",
@@ -30,5 +134,144 @@ func TestString(t *testing.T) {
 		F3:        true,
 		F4:        true,
 	}
-	l.String()
+	if l.String() != "loco:4 |4>| |on| |on|on|on|on|" {
+		t.Error("bad string: ", l.String())
+	}
+
+	l.Address = 2045
+	l.LongAddress = true
+	if l.String() != "loco:2045 |4>| |on| |on|on|on|on|" {
+		t.Error("bad string: ", l.String())
+	}
+}
+
+func TestLocoEmergencyStop(t *testing.T) {
+	l := &Locomotive{
+		Name:      "loco",
+		Address:   3,
+		Speed:     20,
+		Direction: Forward,
+	}
+	l.EmergencyStop()
+	pkts, err := l.packets()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l.Speed != 0 || pkts[0].Describe() != "loco 3 (short) estop fwd" {
+		t.Error("should send emergency stop packets: ", pkts[0].Describe())
+	}
+
+	l.Apply()
+	pkts, _ = l.packets()
+	if pkts[0].Describe() != "loco 3 (short) stop fwd" {
+		t.Error("Apply should release the emergency stop: ", pkts[0].Describe())
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	must := mustBuild(t)
+	l := &Locomotive{Name: "loco", Address: 3, Direction: Forward}
+	l.packets()
+
+	err := l.Update(func(s *LocoState) {
+		s.Speed = 10
+		s.Direction = Backward
+		s.Fl = true
+		s.Functions = map[uint8]bool{5: true, 100: true}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	snap := l.Snapshot()
+	if snap.Speed != 10 || snap.Direction != Backward || !snap.Function(0) || !snap.Function(5) {
+		t.Error("state not updated: ", snap)
+	}
+	if _, ok := snap.Functions[100]; ok {
+		t.Error("functions above MaxFunction should be ignored")
+	}
+	expected := must(NewSpeedDirectionAndLightPacket(Address{Number: 3}, Speed{Step: 10}, Backward, true))
+	if !l.speedPacket.Equal(expected) {
+		t.Error("should have built the new speed packet")
+	}
+
+	// Snapshots do not change the Locomotive.
+	snap.Functions[5] = false
+	if !l.Function(5) {
+		t.Error("modifying a snapshot should not modify the locomotive")
+	}
+
+	if err := l.SetDirection(Forward); err != nil || l.Snapshot().Direction != Forward {
+		t.Error("should have set the direction: ", err)
+	}
+
+	l.EmergencyStop()
+	if err := l.Update(func(s *LocoState) { s.F1 = true }); err != nil {
+		t.Fatal(err)
+	}
+	if !l.Snapshot().EStop {
+		t.Error("only speed changes should end the emergency stop")
+	}
+	if err := l.SetSpeed(5); err != nil {
+		t.Fatal(err)
+	}
+	if l.eStop {
+		t.Error("updates should end the emergency stop")
+	}
+}
+
+func TestUpdateError(t *testing.T) {
+	l := &Locomotive{Name: "bad", Address: 200, Speed: 3}
+	if err := l.SetSpeed(5); !errors.Is(err, ErrBadAddress) {
+		t.Error("should have failed with a bad address: ", err)
+	}
+	if l.Snapshot().Speed != 3 {
+		t.Error("failed update should not modify the locomotive")
+	}
+}
+
+func TestLocoConcurrent(t *testing.T) {
+	l := &Locomotive{Name: "loco", Address: 3}
+	var wg sync.WaitGroup
+	wg.Add(3)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			l.SetSpeed(uint8(i % 14))
+			l.SetFunction(uint8(i%10), i%2 == 0)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			if _, err := l.packets(); err != nil {
+				t.Error(err)
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			_ = l.Snapshot()
+			_ = l.String()
+			if _, err := json.Marshal(l); err != nil {
+				t.Error(err)
+			}
+		}
+	}()
+	wg.Wait()
+}
+
+func TestMarshalJSON(t *testing.T) {
+	l := &Locomotive{Name: "loco", Address: 3, Speed: 4, Functions: map[uint8]bool{10: true}}
+	data, err := json.Marshal(l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded Locomotive
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.String() != l.String() {
+		t.Errorf("expected %s, got %s", l, &decoded)
+	}
 }
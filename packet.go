@@ -1,6 +1,11 @@
 package dcc
 
-import "time"
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"time"
+)
 
 // DCC protocol-defined values for reference.
 const (
@@ -11,6 +16,13 @@ const (
 	PacketSeparationMin    = 5 * time.Millisecond
 	PacketSeparationMax    = 30 * time.Millisecond
 	PreambleBitsMin        = 14
+
+	// The RailCom cutout starts and ends within these times
+	// after the end of the packet end bit.
+	RailComCutoutStartMin = 26 * time.Microsecond
+	RailComCutoutStartMax = 32 * time.Microsecond
+	RailComCutoutEndMin   = 454 * time.Microsecond
+	RailComCutoutEndMax   = 488 * time.Microsecond
 )
 
 // Some customizable DCC-related variables.
@@ -19,74 +31,294 @@ var (
 	BitZeroPartDuration = 100 * time.Microsecond
 	PacketSeparation    = 15 * time.Millisecond
 	PreambleBits        = 16
+
+	// ServiceModePreambleBits is used instead of PreambleBits
+	// for service mode packets, which require a long preamble.
+	ServiceModePreambleBits = 20
+
+	// RailComCutoutStart and RailComCutoutEnd are the times,
+	// after the end of the packet end bit, at which the
+	// RailCom cutout starts and ends.
+	RailComCutoutStart = 29 * time.Microsecond
+	RailComCutoutEnd   = 471 * time.Microsecond
+)
+
+// Address limits for multi-function decoders.
+const (
+	MaxShortAddress = 127
+	MaxLongAddress  = 10239
 )
 
-// HeadlightCompatMode controls if one bit in the speed instruction is
-// reserved for headlight. This reduces speed steps from 32 to 16 steps.
-var HeadlightCompatMode = false
+// maxPacketBytes is the maximum length of a packet, including
+// the error detection byte.
+const maxPacketBytes = 6
+
+// Errors returned when building and sending packets. They are wrapped
+// with details about the problem, so use errors.Is to check for them.
+var (
+	// ErrBadAddress is returned when building packets for addresses
+	// outside the valid range.
+	ErrBadAddress = errors.New("address out of range")
+	// ErrBadValue is returned when building packets with values
+	// outside the valid range, like CV numbers or function numbers.
+	ErrBadValue = errors.New("value out of range")
+	// ErrBadLength is returned when building packets with no data or
+	// which are longer than 6 bytes.
+	ErrBadLength = errors.New("bad packet length")
+	// ErrReservedInstruction is returned when building packets for
+	// multi-function decoders with instructions reserved by the NMRA.
+	ErrReservedInstruction = errors.New("reserved instruction")
+	// ErrNoDriver is returned when sending a packet without a Driver.
+	ErrNoDriver = errors.New("no driver set")
+	// ErrBadTiming is returned when sending a packet while
+	// BitOnePartDuration and BitZeroPartDuration are not valid.
+	ErrBadTiming = errors.New("bad bit timing")
+	// ErrNoCutout is returned when the RailCom cutout is requested
+	// from a Driver which does not implement CutoutDriver.
+	ErrNoCutout = errors.New("driver cannot produce the RailCom cutout")
+)
+
+// Address represents the address of a multi-function decoder (i.e. a
+// locomotive decoder). Short addresses use a single byte and a 7-bit
+// address space. Long (extended) addresses use two bytes and a 14-bit
+// address space. Note that short address 3 and long address 3 are
+// different addresses.
+type Address struct {
+	Number uint16
+	Long   bool
+}
+
+// bytes returns the DCC-encoded representation of the address. Short
+// addresses are encoded as 0AAAAAAA, while long addresses are encoded as
+// 11AAAAAA AAAAAAAA.
+func (a Address) bytes() []byte {
+	if a.Long {
+		n := a.Number & 0x3FFF // 14 bits
+		return []byte{0xC0 | byte(n>>8), byte(n)}
+	}
+	return []byte{byte(a.Number) & 0x7F}
+}
+
+// check returns an error if the address is out of range.
+func (a Address) check() error {
+	max := uint16(MaxShortAddress)
+	if a.Long {
+		max = MaxLongAddress
+	}
+	if a.Number > max {
+		return fmt.Errorf("%w: %s address %d (max %d)", ErrBadAddress,
+			addressType(a), a.Number, max)
+	}
+	return nil
+}
+
+func addressType(a Address) string {
+	if a.Long {
+		return "long"
+	}
+	return "short"
+}
+
+func (a Address) String() string {
+	if a.Long {
+		return fmt.Sprintf("%04d", a.Number)
+	}
+	return fmt.Sprintf("%d", a.Number)
+}
 
 // Packet represents the unit of information that can be sent to the DCC
 // devices in the system. Packet implements the DCC protocol for converting
 // the information into DCC-encoded 1 and 0s.
+//
+// Packets are values: they are not modified once built, and can be
+// cached, compared with Equal and sent with any Driver, including
+// several Drivers at the same time.
 type Packet struct {
-	driver  Driver
-	address byte
+	address []byte
 	data    []byte
 	ecc     byte
 
-	// encoded holds an int64 (time.Duration) for each
-	// bit in a packet. It is an efficient representation
-	// to save extra function calls and IFs when sending
-	encoded []time.Duration
+	// preamble is the number of preamble bits.
+	preamble int
+
+	// bits holds the DCC-encoded packet, one bit per byte.
+	bits []byte
 }
 
-// NewPacket returns a new generic DCC Packet.
-func NewPacket(d Driver, addr byte, data []byte) *Packet {
-	ecc := addr
+// newPacket builds a packet, calculating its error detection byte
+// and its DCC-encoded bits.
+func newPacket(preamble int, address, data []byte) *Packet {
+	var ecc byte
+	for _, i := range address {
+		ecc = ecc ^ i
+	}
 	for _, i := range data {
 		ecc = ecc ^ i
 	}
+	p := &Packet{
+		address:  address,
+		data:     data,
+		ecc:      ecc,
+		preamble: preamble,
+	}
+	p.build()
+	return p
+}
 
-	return &Packet{
-		driver:  d,
-		address: addr,
-		data:    data,
-		ecc:     ecc,
+// checkLength returns an error if a packet with the given address and
+// data would not have a valid length.
+func checkLength(address, data []byte) error {
+	l := len(address) + len(data) + 1
+	if len(data) == 0 || l > maxPacketBytes {
+		return fmt.Errorf("%w: %d bytes of data and %d address bytes",
+			ErrBadLength, len(data), len(address))
 	}
+	return nil
+}
+
+// checkInstruction returns an error if the first byte of the data
+// for a multi-function decoder is a reserved instruction.
+func checkInstruction(data []byte) error {
+	b := data[0]
+	var reserved bool
+	switch b >> 5 {
+	case 0x0:
+		if b>>4 == 0 { // 0b0000CCCF: decoder control
+			cc := (b >> 1) & 0x7
+			reserved = cc == 2 || cc == 4 || cc == 6
+		} else { // 0b0001CCCC: consist control
+			reserved = b&0xFE != 0x12
+		}
+	case 0x1: // 0b001CCCCC: advanced operations
+		reserved = b < 0x3D
+	case 0x6: // 0b110CCCCC: feature expansion
+		reserved = b != 0xC0 && b < 0xDD
+	case 0x7: // 0b111CCCCC: configuration variable access
+		reserved = b&0xFC == 0xE0 // long form with CC=00
+	}
+	if reserved {
+		return fmt.Errorf("%w: %#02x", ErrReservedInstruction, b)
+	}
+	return nil
+}
+
+// NewPacket returns a new generic DCC Packet. It returns an error if the
+// address byte is reserved or starts a long address (0xC0-0xE7, use
+// NewAddressedPacket instead), if the packet length is invalid, or if
+// the instruction for a multi-function decoder (addr 0-127) is reserved.
+func NewPacket(addr byte, data []byte) (*Packet, error) {
+	if addr >= 0xE8 && addr < 0xFF {
+		return nil, fmt.Errorf("%w: reserved address byte %#02x",
+			ErrBadAddress, addr)
+	}
+	if addr >= 0xC0 && addr < 0xE8 {
+		return nil, fmt.Errorf("%w: %#02x is the first byte of a long address",
+			ErrBadAddress, addr)
+	}
+	address := []byte{addr}
+	if err := checkLength(address, data); err != nil {
+		return nil, err
+	}
+	if addr <= MaxShortAddress {
+		if err := checkInstruction(data); err != nil {
+			return nil, err
+		}
+	}
+	return newPacket(PreambleBits, address, data), nil
+}
+
+// NewAddressedPacket returns a new DCC packet for a multi-function
+// decoder using either short or long addressing. It returns an error if
+// the address is out of range, if the packet length is invalid or if the
+// instruction is reserved.
+func NewAddressedPacket(addr Address, data []byte) (*Packet, error) {
+	if err := addr.check(); err != nil {
+		return nil, err
+	}
+	address := addr.bytes()
+	if err := checkLength(address, data); err != nil {
+		return nil, err
+	}
+	if err := checkInstruction(data); err != nil {
+		return nil, err
+	}
+	return newPacket(PreambleBits, address, data), nil
 }
 
 // NewBaselinePacket returns a new generic baseline packet.
 // Baseline packets are different because they use a 128 address
-// space. Therefore the address is forced to start with bit 0.
-func NewBaselinePacket(d Driver, addr byte, data []byte) *Packet {
-	addr = addr & 0x7F // 0b01111111 last 7 bits
-	return NewPacket(d, addr, data)
-}
-
-// NewSpeedAndDirectionPacket returns a new baseline DCC packet with speed and
-// direction information.
-func NewSpeedAndDirectionPacket(d Driver, addr byte, speed byte, dir Direction) *Packet {
-	addr = addr & 0x7F // 0b 0111 1111
-	if HeadlightCompatMode {
-		speed = speed & 0x0F // 4 lower bytes
-	} else {
-		speed = speed & 0x1F // 5 lower bytes
+// space. Therefore addresses over 127 are an error.
+func NewBaselinePacket(addr byte, data []byte) (*Packet, error) {
+	return NewAddressedPacket(Address{Number: uint16(addr)}, data)
+}
+
+// NewSpeedAndDirectionPacket returns a new DCC packet with speed and
+// direction information. 14 and 28-step speeds use the baseline speed and
+// direction instruction (a baseline packet when using a short address),
+// while 128-step speeds use the advanced operations instruction (see
+// NewAdvancedSpeedPacket). In 14-step mode, the headlight (FL) is turned
+// off. Use NewSpeedDirectionAndLightPacket to control it.
+func NewSpeedAndDirectionPacket(addr Address, speed Speed, dir Direction) (*Packet, error) {
+	return NewSpeedDirectionAndLightPacket(addr, speed, dir, false)
+}
+
+// NewSpeedDirectionAndLightPacket works like NewSpeedAndDirectionPacket,
+// but sets the headlight (FL) to the given state when using 14 speed
+// steps. The fl value is ignored in other modes.
+func NewSpeedDirectionAndLightPacket(addr Address, speed Speed, dir Direction, fl bool) (*Packet, error) {
+	if speed.Steps == SpeedSteps128 {
+		return NewAdvancedSpeedPacket(addr, speed, dir)
+	}
+
+	speedB := speed.baseline()
+	if speed.Steps == SpeedSteps14 && fl {
+		speedB = speedB | (1 << 4)
 	}
 
 	dirB := byte(0x1&dir) << 5
-	data := (1 << 6) | dirB | speed // 0b01DCSSSS
+	data := (1 << 6) | dirB | speedB // 0b01DCSSSS
 
-	return &Packet{
-		driver:  d,
-		address: addr,
-		data:    []byte{data},
-		ecc:     addr ^ data,
+	return NewAddressedPacket(addr, []byte{data})
+}
+
+// NewConsistControlPacket returns an advanced DCC packet with a Consist
+// Control instruction, which places a multi-function decoder in an
+// advanced consist by setting its consist address (1-127) in CV19:
+// 0001001D 0CCCCCCC. When reversed is true, the decoder runs in the
+// opposite direction to the one requested for the consist. Consist
+// address 0 removes the decoder from the consist.
+func NewConsistControlPacket(addr Address, consist uint8, reversed bool) (*Packet, error) {
+	if consist > 127 {
+		return nil, fmt.Errorf("%w: consist address %d (max 127)",
+			ErrBadValue, consist)
+	}
+	var dB byte
+	if reversed {
+		dB = 1
+	}
+	data := []byte{
+		0x12 | dB, // 0b0001001D
+		consist,   // 0b0CCCCCCC
 	}
+	return NewAddressedPacket(addr, data)
+}
+
+// NewAdvancedSpeedPacket returns a new DCC packet using the 128 speed step
+// control instruction from the Advanced Operations instruction group. The
+// speed step is interpreted in 128-step mode regardless of speed.Steps.
+func NewAdvancedSpeedPacket(addr Address, speed Speed, dir Direction) (*Packet, error) {
+	dirB := byte(0x1&dir) << 7
+	data := []byte{
+		0x3F,                    // 0b00111111: 128 speed step control
+		dirB | speed.advanced(), // 0bDSSSSSSS
+	}
+
+	return NewAddressedPacket(addr, data)
 }
 
 // NewFunctionGroupOnePacket returns an advanced DCC packet which allows to
 // control FL,F1-F4 functions. FL is usually associated to the headlights.
-func NewFunctionGroupOnePacket(d Driver, addr byte, fl, fl1, fl2, fl3, fl4 bool) *Packet {
+func NewFunctionGroupOnePacket(addr Address, fl, fl1, fl2, fl3, fl4 bool) (*Packet, error) {
 	var data, fln, fl1n, fl2n, fl3n, fl4n byte = 0, 0, 0, 0, 0, 0
 	if fl {
 		fln = 1 << 4
@@ -106,41 +338,373 @@ func NewFunctionGroupOnePacket(d Driver, addr byte, fl, fl1, fl2, fl3, fl4 bool)
 
 	data = (1 << 7) | fln | fl1n | fl2n | fl3n | fl4n
 
-	return &Packet{
-		driver:  d,
-		address: addr,
-		data:    []byte{data},
-		ecc:     addr ^ data,
+	return NewAddressedPacket(addr, []byte{data})
+}
+
+// functionBits packs up to 8 function states into a byte, with the
+// first function in the least significant bit.
+func functionBits(fns ...bool) byte {
+	var b byte
+	for i, f := range fns {
+		if f {
+			b = b | (1 << uint(i))
+		}
+	}
+	return b
+}
+
+// NewFunctionGroupTwoPacket returns an advanced DCC packet which allows to
+// control F5-F8 functions.
+func NewFunctionGroupTwoPacket(addr Address, f5, f6, f7, f8 bool) (*Packet, error) {
+	data := 0xB0 | functionBits(f5, f6, f7, f8) // 0b1011 F8F7F6F5
+	return NewAddressedPacket(addr, []byte{data})
+}
+
+// NewFunctionGroupThreePacket returns an advanced DCC packet which allows
+// to control F9-F12 functions. This is the second form of the Function
+// Group Two instruction, commonly referred to as Function Group Three.
+func NewFunctionGroupThreePacket(addr Address, f9, f10, f11, f12 bool) (*Packet, error) {
+	data := 0xA0 | functionBits(f9, f10, f11, f12) // 0b1010 F12F11F10F9
+	return NewAddressedPacket(addr, []byte{data})
+}
+
+// NewFunctionsF13F20Packet returns an advanced DCC packet using the F13-F20
+// Function Control feature expansion instruction. The states byte holds
+// F13 in the least significant bit and F20 in the most significant one.
+func NewFunctionsF13F20Packet(addr Address, states byte) (*Packet, error) {
+	data := []byte{
+		0xDE, // 0b11011110: F13-F20 function control
+		states,
+	}
+	return NewAddressedPacket(addr, data)
+}
+
+// NewFunctionsF21F28Packet returns an advanced DCC packet using the F21-F28
+// Function Control feature expansion instruction. The states byte holds
+// F21 in the least significant bit and F28 in the most significant one.
+func NewFunctionsF21F28Packet(addr Address, states byte) (*Packet, error) {
+	data := []byte{
+		0xDF, // 0b11011111: F21-F28 function control
+		states,
+	}
+	return NewAddressedPacket(addr, data)
+}
+
+// NewBinaryStatePacket returns an advanced DCC packet using the Binary
+// State Control feature expansion instruction. States 1-127 use the short
+// form of the instruction, while higher states (up to 32767) use the long
+// form. State 0 is a broadcast to all binary states of the decoder.
+func NewBinaryStatePacket(addr Address, state uint16, on bool) (*Packet, error) {
+	if state > maxBinaryState {
+		return nil, fmt.Errorf("%w: binary state %d (max %d)",
+			ErrBadValue, state, maxBinaryState)
+	}
+
+	var dB byte
+	if on {
+		dB = 1 << 7
+	}
+
+	var data []byte
+	if state < 128 {
+		data = []byte{
+			0xDD,                  // 0b11011101: short form
+			dB | byte(state)&0x7F, // 0bDLLLLLLL
+		}
+	} else {
+		data = []byte{
+			0xC0,                  // 0b11000000: long form
+			dB | byte(state)&0x7F, // 0bDLLLLLLL
+			byte(state >> 7),      // 0bHHHHHHHH
+		}
+	}
+	return NewAddressedPacket(addr, data)
+}
+
+// maxBinaryState is the highest state number in the
+// Binary State Control instruction.
+const maxBinaryState = 32767
+
+// Configuration Variable Access instruction types.
+const (
+	cvVerifyByte byte = 0x1 // 0b01
+	cvBitManip   byte = 0x2 // 0b10
+	cvWriteByte  byte = 0x3 // 0b11
+)
+
+// cvAccess returns the instruction bytes for the long form of the
+// Configuration Variable Access instruction: 1110CCVV VVVVVVVV DDDDDDDD.
+// CVs are numbered from 1 to 1024 and encoded as 0 to 1023.
+func cvAccess(cc byte, cv uint16, data byte) []byte {
+	a := (cv - 1) & 0x3FF // 10 bits
+	return []byte{
+		0xE0 | cc<<2 | byte(a>>8),
+		byte(a),
+		data,
+	}
+}
+
+// checkCV returns an error if the CV number is not 1-1024.
+func checkCV(cv uint16) error {
+	if cv < 1 || cv > 1024 {
+		return fmt.Errorf("%w: CV%d (must be 1-1024)", ErrBadValue, cv)
+	}
+	return nil
+}
+
+// checkRegister returns an error if the register is not 1-8.
+func checkRegister(reg uint8) error {
+	if reg < 1 || reg > 8 {
+		return fmt.Errorf("%w: register %d (must be 1-8)", ErrBadValue, reg)
+	}
+	return nil
+}
+
+// checkBit returns an error if the bit position is not 0-7.
+func checkBit(bit uint8) error {
+	if bit > 7 {
+		return fmt.Errorf("%w: bit %d (must be 0-7)", ErrBadValue, bit)
 	}
+	return nil
+}
+
+// cvBit returns the data byte for the bit manipulation form of the
+// Configuration Variable Access instruction: 111KDBBB, where K is set for
+// writes, D is the bit value and BBB the bit position (0-7).
+func cvBit(write bool, bit uint8, value bool) byte {
+	var k, d byte
+	if write {
+		k = 1 << 4
+	}
+	if value {
+		d = 1 << 3
+	}
+	return 0xE0 | k | d | (bit & 0x7)
+}
+
+// NewPOMWriteBytePacket returns an operations mode (programming on the
+// main) DCC packet which writes the given value to a configuration
+// variable (CV 1-1024) of a multi-function decoder.
+func NewPOMWriteBytePacket(addr Address, cv uint16, value byte) (*Packet, error) {
+	if err := checkCV(cv); err != nil {
+		return nil, err
+	}
+	return NewAddressedPacket(addr, cvAccess(cvWriteByte, cv, value))
+}
+
+// NewPOMWriteBitPacket returns an operations mode DCC packet which writes
+// a single bit (0-7) of a configuration variable of a multi-function
+// decoder.
+func NewPOMWriteBitPacket(addr Address, cv uint16, bit uint8, value bool) (*Packet, error) {
+	if err := checkCV(cv); err != nil {
+		return nil, err
+	}
+	if err := checkBit(bit); err != nil {
+		return nil, err
+	}
+	return NewAddressedPacket(addr,
+		cvAccess(cvBitManip, cv, cvBit(true, bit, value)))
+}
+
+// NewPOMVerifyBytePacket returns an operations mode DCC packet which asks
+// a multi-function decoder to verify that a configuration variable holds
+// the given value.
+func NewPOMVerifyBytePacket(addr Address, cv uint16, value byte) (*Packet, error) {
+	if err := checkCV(cv); err != nil {
+		return nil, err
+	}
+	return NewAddressedPacket(addr, cvAccess(cvVerifyByte, cv, value))
+}
+
+// newServiceModePacket returns a new packet using the long
+// preamble required in service mode. Service mode packets
+// have no address byte.
+func newServiceModePacket(data []byte) *Packet {
+	return newPacket(ServiceModePreambleBits, nil, data)
+}
+
+// directAccess returns the instruction bytes for the service mode direct
+// CV addressing instruction: 0111CCAA AAAAAAAA DDDDDDDD. It is the same as
+// the operations mode one, with a different instruction prefix.
+func directAccess(cc byte, cv uint16, data byte) []byte {
+	b := cvAccess(cc, cv, data)
+	b[0] = 0x70 | (b[0] & 0x0F)
+	return b
+}
+
+// NewServiceModeResetPacket returns a reset packet with the long preamble
+// used in service mode.
+func NewServiceModeResetPacket() *Packet {
+	return newServiceModePacket([]byte{0, 0})
+}
+
+// NewDirectWriteBytePacket returns a service mode packet which writes
+// the given value to a configuration variable (CV 1-1024) using direct
+// CV addressing.
+func NewDirectWriteBytePacket(cv uint16, value byte) (*Packet, error) {
+	if err := checkCV(cv); err != nil {
+		return nil, err
+	}
+	return newServiceModePacket(directAccess(cvWriteByte, cv, value)), nil
+}
+
+// NewDirectVerifyBytePacket returns a service mode packet which asks the
+// decoder to verify that a configuration variable holds the given value
+// using direct CV addressing.
+func NewDirectVerifyBytePacket(cv uint16, value byte) (*Packet, error) {
+	if err := checkCV(cv); err != nil {
+		return nil, err
+	}
+	return newServiceModePacket(directAccess(cvVerifyByte, cv, value)), nil
+}
+
+// NewDirectWriteBitPacket returns a service mode packet which writes a
+// single bit (0-7) of a configuration variable using direct CV
+// addressing.
+func NewDirectWriteBitPacket(cv uint16, bit uint8, value bool) (*Packet, error) {
+	if err := checkCV(cv); err != nil {
+		return nil, err
+	}
+	if err := checkBit(bit); err != nil {
+		return nil, err
+	}
+	return newServiceModePacket(directAccess(cvBitManip, cv, cvBit(true, bit, value))), nil
+}
+
+// NewDirectVerifyBitPacket returns a service mode packet which asks the
+// decoder to verify a single bit (0-7) of a configuration variable using
+// direct CV addressing.
+func NewDirectVerifyBitPacket(cv uint16, bit uint8, value bool) (*Packet, error) {
+	if err := checkCV(cv); err != nil {
+		return nil, err
+	}
+	if err := checkBit(bit); err != nil {
+		return nil, err
+	}
+	return newServiceModePacket(directAccess(cvBitManip, cv, cvBit(false, bit, value))), nil
+}
+
+// NewRegisterWritePacket returns a service mode packet which writes a
+// value to one of the 8 decoder registers (1-8) using physical register
+// addressing: 0111CRRR DDDDDDDD. It is also used for paged addressing,
+// where registers 1-4 hold the CVs in the selected page and register 6
+// is the page register.
+func NewRegisterWritePacket(reg uint8, value byte) (*Packet, error) {
+	if err := checkRegister(reg); err != nil {
+		return nil, err
+	}
+	data := []byte{
+		0x78 | ((reg - 1) & 0x7), // 0b01111RRR
+		value,
+	}
+	return newServiceModePacket(data), nil
+}
+
+// NewRegisterVerifyPacket returns a service mode packet which asks the
+// decoder to verify the value of one of its 8 registers (1-8) using
+// physical register addressing.
+func NewRegisterVerifyPacket(reg uint8, value byte) (*Packet, error) {
+	if err := checkRegister(reg); err != nil {
+		return nil, err
+	}
+	data := []byte{
+		0x70 | ((reg - 1) & 0x7), // 0b01110RRR
+		value,
+	}
+	return newServiceModePacket(data), nil
+}
+
+// Accessory decoder address limits.
+const (
+	MaxAccessoryAddress       = 511
+	MaxAccessoryOutputAddress = 2044
+)
+
+// NewBasicAccessoryPacket returns a basic accessory decoder packet
+// using the 9-bit decoder address (0-511): 10AAAAAA 1AAACDDD. The
+// three most significant bits of the address are sent in ones
+// complement. Each decoder controls four pairs of outputs: pair (0-3)
+// selects the pair and output (0-1) the output in it. Activate sets
+// the state of the selected output.
+func NewBasicAccessoryPacket(addr uint16, pair uint8, output uint8, activate bool) (*Packet, error) {
+	if addr > MaxAccessoryAddress {
+		return nil, fmt.Errorf("%w: accessory decoder %d (max %d)",
+			ErrBadAddress, addr, MaxAccessoryAddress)
+	}
+	if pair > 3 || output > 1 {
+		return nil, fmt.Errorf("%w: output pair %d output %d (must be 0-3 and 0-1)",
+			ErrBadValue, pair, output)
+	}
+
+	var c byte
+	if activate {
+		c = 1 << 3
+	}
+
+	high := ^byte(addr>>6) & 0x7
+	data := 0x80 | high<<4 | c | pair<<1 | output // 0b1AAACDDD
+	address := 0x80 | byte(addr)&0x3F             // 0b10AAAAAA
+	return newPacket(PreambleBits, []byte{address}, []byte{data}), nil
+}
+
+// accessoryOutput returns the decoder address and output pair for an
+// accessory output address (1-2044). Output address 1 corresponds to the
+// first pair of outputs of decoder 1.
+func accessoryOutput(addr uint16) (uint16, uint8, error) {
+	if addr < 1 || addr > MaxAccessoryOutputAddress {
+		return 0, 0, fmt.Errorf("%w: accessory output %d (must be 1-%d)",
+			ErrBadAddress, addr, MaxAccessoryOutputAddress)
+	}
+	return (addr-1)/4 + 1, uint8((addr - 1) % 4), nil
+}
+
+// NewAccessoryOutputPacket returns a basic accessory decoder packet using
+// the 11-bit output addressing (1-2044), where every address
+// corresponds to an output pair of a decoder. This is the way most
+// systems number turnouts.
+func NewAccessoryOutputPacket(addr uint16, output uint8, activate bool) (*Packet, error) {
+	decoder, pair, err := accessoryOutput(addr)
+	if err != nil {
+		return nil, err
+	}
+	return NewBasicAccessoryPacket(decoder, pair, output, activate)
+}
+
+// NewExtendedAccessoryPacket returns an extended accessory decoder
+// packet, used to set the aspect (0-255) of signals, among others:
+// 10AAAAAA 0AAA0AA1 DDDDDDDD. The output address (1-2044) is numbered
+// like in NewAccessoryOutputPacket and sent as an 11-bit address. Aspect
+// 0 is defined as absolute stop, while the meaning of the rest depends
+// on the decoder.
+func NewExtendedAccessoryPacket(addr uint16, aspect byte) (*Packet, error) {
+	decoder, pair, err := accessoryOutput(addr)
+	if err != nil {
+		return nil, err
+	}
+	raw := decoder<<2 | uint16(pair) // 11 bits
+	high := ^byte(raw>>8) & 0x7
+	data := high<<4 | byte(raw&0x3)<<1 | 0x1 // 0b0AAA0AA1
+	address := 0x80 | byte(raw>>2)&0x3F      // 0b10AAAAAA
+	return newPacket(PreambleBits, []byte{address}, []byte{data, aspect}), nil
 }
 
 // NewBroadcastResetPacket returns a new broadcast baseline DCC packet which
 // makes the decoders erase their volatile memory and return to power up
 // state. This stops all locomotives at non-zero speed.
-func NewBroadcastResetPacket(d Driver) *Packet {
-	return &Packet{
-		driver:  d,
-		address: 0,
-		data:    []byte{0},
-		ecc:     0 ^ 0,
-	}
+func NewBroadcastResetPacket() *Packet {
+	return newPacket(PreambleBits, []byte{0}, []byte{0})
 }
 
 // NewBroadcastIdlePacket returns a new broadcast baseline DCC packet
 // on which decoders perform no action.
-func NewBroadcastIdlePacket(d Driver) *Packet {
-	return &Packet{
-		driver:  d,
-		address: 0xFF,
-		data:    []byte{0},
-		ecc:     0xFF ^ 0,
-	}
+func NewBroadcastIdlePacket() *Packet {
+	return newPacket(PreambleBits, []byte{0xFF}, []byte{0})
 }
 
 // NewBroadcastStopPacket returns a new broadcast baseline DCC packet which
 // tells the decoders to stop all locomotives. If softStop is false, an
 // emergency stop will happen by cutting power off the engine.
-func NewBroadcastStopPacket(d Driver, dir Direction, softStop bool, ignoreDir bool) *Packet {
+func NewBroadcastStopPacket(dir Direction, softStop bool, ignoreDir bool) *Packet {
 	var speed byte
 	if !softStop {
 		speed = 1
@@ -154,62 +718,138 @@ func NewBroadcastStopPacket(d Driver, dir Direction, softStop bool, ignoreDir bo
 
 	data := (1 << 6) | (dirB << 5) | speed
 
-	return &Packet{
-		driver:  d,
-		address: 0x0,
-		data:    []byte{data},
-		ecc:     0x0 ^ data,
+	return newPacket(PreambleBits, []byte{0x0}, []byte{data})
+}
+
+// PacketPause performs a pause by sleeping during the PacketSeparation
+// time, as measured by the Driver's clock (see Clocked).
+func PacketPause(d Driver) error {
+	if d == nil {
+		return ErrNoDriver
 	}
+	// Not really needed
+	d.Low()
+	driverClock(d).Sleep(PacketSeparation)
+	d.High()
+	return nil
 }
 
-// delayPoll causes a active delay for the specified time
-// by actively polling the clock. Unfortunately, for latencies
-// under 100us, it is not possible to sleep reliably with
-// syscall.Nanosleep().
-func delayPoll(now time.Time, d time.Duration) {
-	for {
-		if time.Since(now) > d {
-			return
-		}
+// RailComCutout produces the RailCom cutout. It must be called right
+// after sending a packet: the tracks are powered off between
+// RailComCutoutStart and RailComCutoutEnd, as measured by the Driver's
+// clock (see Clocked), and then powered again so that the next packet can
+// be sent. The Driver must implement CutoutDriver.
+func RailComCutout(d Driver) error {
+	if d == nil {
+		return ErrNoDriver
+	}
+	cd, ok := d.(CutoutDriver)
+	if !ok {
+		return ErrNoCutout
+	}
+	start, end := RailComCutoutStart, RailComCutoutEnd
+	if start < 0 || end <= start {
+		return fmt.Errorf("%w: RailCom cutout from %s to %s",
+			ErrBadTiming, start, end)
 	}
+
+	clk := driverClock(d)
+	d.Low()
+	clk.Sleep(start)
+	cd.CutoutStart()
+	clk.Sleep(end - start)
+	cd.CutoutEnd()
+	return nil
 }
 
-// PacketPause performs a pause by sleeping
-// during the PacketSeparation time.
-func (p *Packet) PacketPause() {
-	// Not really needed
-	p.driver.Low()
-	time.Sleep(PacketSeparation)
-	p.driver.High()
+// bitDurations returns the durations of each half of 1 and 0 bits, or
+// an error if BitOnePartDuration and BitZeroPartDuration are not valid.
+func bitDurations() (time.Duration, time.Duration, error) {
+	one, zero := BitOnePartDuration, BitZeroPartDuration
+	if one <= 0 || zero <= one {
+		return 0, 0, fmt.Errorf("%w: 1 lasts %s and 0 lasts %s",
+			ErrBadTiming, one, zero)
+	}
+	return one, zero, nil
+}
+
+// Send sends a packet using the given Driver. The bit durations are taken
+// from BitOnePartDuration and BitZeroPartDuration. Drivers implementing
+// WaveformDriver receive the whole packet at once. Otherwise, Send calls
+// Low() and High() for every half-bit and waits in between using the
+// Driver's clock (see Clocked).
+func (p *Packet) Send(d Driver) error {
+	if d == nil {
+		return ErrNoDriver
+	}
+	if wd, ok := d.(WaveformDriver); ok {
+		halfBits, err := p.Waveform()
+		if err != nil {
+			return err
+		}
+		return wd.SendWaveform(halfBits)
+	}
+
+	one, zero, err := bitDurations()
+	if err != nil {
+		return err
+	}
+
+	clk := driverClock(d)
+	for _, bit := range p.bits {
+		b := zero
+		if bit == 1 {
+			b = one
+		}
+		d.Low()
+		clk.Sleep(b)
+		d.High()
+		clk.Sleep(b)
+	}
+	return nil
 }
 
-// Send encodes and sends a packet using the Driver associated to it.
-func (p *Packet) Send() {
-	if p.driver == nil {
-		panic("No driver set")
+// Waveform returns the durations of the half-bits of the DCC-encoded
+// packet, as expected by WaveformDriver: every bit is made of a low part
+// followed by a high part of the same length.
+func (p *Packet) Waveform() ([]time.Duration, error) {
+	durs, err := p.durations()
+	if err != nil {
+		return nil, err
 	}
-	if p.encoded == nil {
-		p.build()
+	halfBits := make([]time.Duration, 0, 2*len(durs))
+	for _, d := range durs {
+		halfBits = append(halfBits, d, d)
 	}
+	return halfBits, nil
+}
 
-	// The way p.encoded is we reduce function calls and ifs
-	for _, b := range p.encoded {
-		p.driver.Low()
-		now := time.Now()
-		delayPoll(now, b)
-		p.driver.High()
-		now = time.Now()
-		delayPoll(now, b)
+// durations returns the duration of each bit of the packet.
+func (p *Packet) durations() ([]time.Duration, error) {
+	one, zero, err := bitDurations()
+	if err != nil {
+		return nil, err
+	}
+	durs := make([]time.Duration, len(p.bits))
+	for i, bit := range p.bits {
+		if bit == 1 {
+			durs[i] = one
+		} else {
+			durs[i] = zero
+		}
 	}
+	return durs, nil
 }
 
 // Length returns the length of the DCC-encoded representation
 // of a packet.
 func (p *Packet) Length() int {
 	l := 0
-	l += PreambleBits // Preamble
-	l += 1            // Packet start
-	l += 8            // Address byte
+	l += p.preamble // Preamble
+	for i := 0; i < len(p.address); i++ {
+		l += 1 // Packet or data start
+		l += 8 // Address byte
+	}
 	for i := 0; i < len(p.data); i++ {
 		l += 1 // Data start
 		l += 8 // Data byte
@@ -220,63 +860,85 @@ func (p *Packet) Length() int {
 	return l
 }
 
-// By prebuilding packages we ensure more consistent Send() times.
+// build calculates the DCC-encoded bits of the packet. By prebuilding
+// packets we ensure more consistent Send() times.
 func (p *Packet) build() {
-	enc := make([]time.Duration, 0, p.Length())
+	bits := make([]byte, 0, p.Length())
 
-	unpackByte := func(b byte) []time.Duration {
-		bs := make([]time.Duration, 8, 8)
+	unpackByte := func(b byte) []byte {
+		bs := make([]byte, 8, 8)
 		for i := uint8(0); i < 8; i++ {
-			bit := (b >> (7 - i)) & 0x1
-			if bit == 0 {
-				bs[i] = BitZeroPartDuration
-			} else {
-				bs[i] = BitOnePartDuration
-			}
+			bs[i] = (b >> (7 - i)) & 0x1
 		}
 		return bs
 	}
 
 	// Preamble
-	for i := 0; i < PreambleBits; i++ {
-		enc = append(enc, BitOnePartDuration)
+	for i := 0; i < p.preamble; i++ {
+		bits = append(bits, 1)
 	}
 
-	// Packet start bit
-	enc = append(enc, BitZeroPartDuration)
-
-	// Address
-	enc = append(enc, unpackByte(p.address)...)
+	// Address. First start bit is the packet start bit.
+	for _, a := range p.address {
+		bits = append(bits, 0)                // Packet or data start
+		bits = append(bits, unpackByte(a)...) // Address
+	}
 
 	// Data
 	for _, d := range p.data {
-		enc = append(enc, BitZeroPartDuration) // Data start
-		enc = append(enc, unpackByte(d)...)    // Data
+		bits = append(bits, 0)                // Data start
+		bits = append(bits, unpackByte(d)...) // Data
 	}
 
 	// ECC
-	enc = append(enc, BitZeroPartDuration) // ECC start
-	enc = append(enc, unpackByte(p.ecc)...)
+	bits = append(bits, 0) // ECC start
+	bits = append(bits, unpackByte(p.ecc)...)
 
 	// Packet end
-	enc = append(enc, BitOnePartDuration)
+	bits = append(bits, 1)
+
+	p.bits = bits
+}
+
+// Bytes returns the bytes of the packet: the address, the instruction
+// bytes and the error detection byte. Service mode packets have no
+// address. The returned slice can be modified freely.
+func (p *Packet) Bytes() []byte {
+	frame := make([]byte, 0, len(p.address)+len(p.data)+1)
+	frame = append(frame, p.address...)
+	frame = append(frame, p.data...)
+	return append(frame, p.ecc)
+}
+
+// Equal returns true when both packets have the same bytes and
+// preamble length, and are therefore sent in the same way.
+func (p *Packet) Equal(o *Packet) bool {
+	return p.preamble == o.preamble &&
+		len(p.address) == len(o.address) &&
+		bytes.Equal(p.Bytes(), o.Bytes())
+}
 
-	p.encoded = enc
+// Describe returns a human-readable description of the packet, like
+// "loco 3 (short) speed 14/28 fwd" or "accessory 12 output 1 on". Packets
+// which cannot be decoded are described by their bytes. See ParseFrame.
+func (p *Packet) Describe() string {
+	var i Instruction
+	var err error
+	if p.address == nil {
+		i, err = ParseServiceModeFrame(p.Bytes())
+	} else {
+		i, err = ParseFrame(p.Bytes())
+	}
+	if err != nil {
+		return fmt.Sprintf("packet % x (%s)", p.Bytes(), err)
+	}
+	return i.String()
 }
 
 func (p *Packet) String() string {
-	if p.encoded == nil {
-		p.build()
-	}
-	var str string
-	for _, b := range p.encoded {
-		if b == BitZeroPartDuration {
-			str += "0"
-		} else if b == BitOnePartDuration {
-			str += "1"
-		} else {
-			panic("bad encoding")
-		}
+	str := make([]byte, len(p.bits))
+	for i, b := range p.bits {
+		str[i] = '0' + b
 	}
-	return str
+	return string(str)
 }
@@ -1,23 +1,24 @@
 package dcc
 
 import (
-	"os"
+	"bytes"
+	"errors"
+	"reflect"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/hsanjuan/go-dcc/clock"
 	"github.com/hsanjuan/go-dcc/driver/dummy"
 )
 
 func TestSend(t *testing.T) {
-	if os.Getenv("TRAVIS") == "true" {
-		// This facilitates that tests pass on travis :(
-		dummy.ByteOneMax = 94 * time.Microsecond
-	}
 	d := &dummy.DCCDummy{}
-	p := NewBroadcastIdlePacket(d)
+	p := NewBroadcastIdlePacket()
 	d.TracksOn()
-	p.Send()
-	time.Sleep(1 * time.Second)
+	if err := p.Send(d); err != nil {
+		t.Fatal(err)
+	}
 	packetStr := dummy.GuessBuffer.String()
 	t.Log("Pckt: ", p.String())
 	t.Log("Sent: ", packetStr)
@@ -27,51 +28,559 @@ func TestSend(t *testing.T) {
 	}
 }
 
+// pollingDummy hides the WaveformDriver implementation of DCCDummy so
+// that packets are sent with Low() and High().
+type pollingDummy struct {
+	d *dummy.DCCDummy
+}
+
+func (p pollingDummy) Low()               { p.d.Low() }
+func (p pollingDummy) High()              { p.d.High() }
+func (p pollingDummy) TracksOn()          { p.d.TracksOn() }
+func (p pollingDummy) TracksOff()         { p.d.TracksOff() }
+func (p pollingDummy) Clock() clock.Clock { return p.d.Clock() }
+
+func TestSendVirtualClock(t *testing.T) {
+	clk := &clock.Virtual{}
+	d := pollingDummy{&dummy.DCCDummy{Time: clk}}
+	p := NewBroadcastIdlePacket()
+	d.TracksOn()
+	if err := p.Send(d); err != nil {
+		t.Fatal(err)
+	}
+	if err := PacketPause(d); err != nil {
+		t.Fatal(err)
+	}
+	if dummy.GuessBuffer.String() != p.String()+"\n" {
+		t.Error("should have sent the packet and a pause: ", dummy.GuessBuffer.String())
+	}
+
+	halfBits, _ := p.Waveform()
+	var expected time.Duration
+	for _, hb := range halfBits {
+		expected += hb
+	}
+	expected += PacketSeparation
+	if elapsed := clk.Now().Sub(time.Time{}); elapsed != expected {
+		t.Errorf("sending took %s, expected %s", elapsed, expected)
+	}
+}
+
 func TestNewPacket(t *testing.T) {
-	p := NewPacket(&dummy.DCCDummy{}, 0xFF, []byte{0x01})
+	must := mustBuild(t)
+	p := must(NewPacket(0xFF, []byte{0x01}))
 	if p.String() != "11111111111111110111111110000000010111111101" {
 		t.Error("Bad packet: ", p.String())
 	}
 }
 
 func TestNewBaselinePacket(t *testing.T) {
-	p := NewBaselinePacket(&dummy.DCCDummy{}, 0xFF, []byte{0x01})
+	must := mustBuild(t)
+	p := must(NewBaselinePacket(0x7F, []byte{0x01}))
 	if p.String() != "11111111111111110011111110000000010011111101" {
 		t.Error("Bad packet: ", p.String())
 	}
+
+	_, err := NewBaselinePacket(0xFF, []byte{0x01})
+	if !errors.Is(err, ErrBadAddress) {
+		t.Error("should not build baseline packets for address 255: ", err)
+	}
 }
 
 func TestIdlePacket(t *testing.T) {
-	p := NewBroadcastIdlePacket(&dummy.DCCDummy{})
+	p := NewBroadcastIdlePacket()
 	if p.String() != "11111111111111110111111110000000000111111111" {
 		t.Error("Bad idle packet")
 	}
 }
 
 func TestNewSpeedAndDirectionPacket(t *testing.T) {
-	p := NewSpeedAndDirectionPacket(&dummy.DCCDummy{}, 0xFF, 0xFF, Forward)
+	must := mustBuild(t)
+	p := must(NewSpeedAndDirectionPacket(Address{Number: 0x7F}, Speed{Step: 0xFF}, Forward))
 	if p.String() != "11111111111111110011111110011111110000000001" {
 		t.Error("Bad speed and direction packet: ", p.String())
 	}
+
+	// Long address 2045 (0x07FD): 11000111 11111101
+	p = must(NewSpeedAndDirectionPacket(Address{Number: 2045, Long: true}, Speed{Step: 1}, Backward))
+	if p.String() != "11111111111111110110001110111111010010000100011110001" {
+		t.Error("Bad long address speed and direction packet: ", p.String())
+	}
+}
+
+func TestAddress(t *testing.T) {
+	short := Address{Number: 3}
+	if b := short.bytes(); len(b) != 1 || b[0] != 0x03 {
+		t.Error("bad short address encoding: ", b)
+	}
+	long := Address{Number: 3, Long: true}
+	if b := long.bytes(); len(b) != 2 || b[0] != 0xC0 || b[1] != 0x03 {
+		t.Error("bad long address encoding: ", b)
+	}
+	long = Address{Number: MaxLongAddress, Long: true}
+	if b := long.bytes(); len(b) != 2 || b[0] != 0xE7 || b[1] != 0xFF {
+		t.Error("bad long address encoding: ", b)
+	}
+	if short.String() != "3" || long.String() != "10239" {
+		t.Error("bad address strings")
+	}
 }
 
 func TestNewFunctionGroupOnePacket(t *testing.T) {
-	p := NewFunctionGroupOnePacket(&dummy.DCCDummy{}, 0xFF, true, true, true, true, true)
-	if p.String() != "11111111111111110111111110100111110011000001" {
+	must := mustBuild(t)
+	p := must(NewFunctionGroupOnePacket(Address{Number: 0x7F}, true, true, true, true, true))
+	if p.String() != "11111111111111110011111110100111110111000001" {
 		t.Error("Bad Function Group One packet: ", p.String())
 	}
 }
 
 func TestNewBroadcastResetPacket(t *testing.T) {
-	p := NewBroadcastResetPacket(&dummy.DCCDummy{})
+	p := NewBroadcastResetPacket()
 	if p.String() != "11111111111111110000000000000000000000000001" {
 		t.Error("Bad reset packet")
 	}
 }
 
 func TestNewBroadcastStopPacket(t *testing.T) {
-	p := NewBroadcastStopPacket(&dummy.DCCDummy{}, Backward, true, false)
+	p := NewBroadcastStopPacket(Backward, true, false)
 	if p.String() != "11111111111111110000000000010000000010000001" {
 		t.Error("Bad stop packet: ", p.String())
 	}
 }
+
+func TestNewSpeedDirectionAndLightPacket(t *testing.T) {
+	must := mustBuild(t)
+	addr := Address{Number: 3}
+	speed := Speed{Step: 5, Steps: SpeedSteps14}
+	p := must(NewSpeedDirectionAndLightPacket(addr, speed, Forward, true))
+	if p.data[0] != 0x76 { // 0b01110110
+		t.Errorf("bad 14-step packet with light: %08b", p.data[0])
+	}
+	p = must(NewSpeedDirectionAndLightPacket(addr, speed, Forward, false))
+	if p.data[0] != 0x66 { // 0b01100110
+		t.Errorf("bad 14-step packet without light: %08b", p.data[0])
+	}
+
+	speed.Steps = SpeedSteps128
+	p = must(NewSpeedDirectionAndLightPacket(addr, speed, Forward, true))
+	if len(p.data) != 2 || p.data[0] != 0x3F || p.data[1] != 0x86 {
+		t.Error("should have used the 128 speed step instruction")
+	}
+}
+
+func TestNewAdvancedSpeedPacket(t *testing.T) {
+	must := mustBuild(t)
+	p := must(NewAdvancedSpeedPacket(Address{Number: 3}, Speed{Step: 126, Steps: SpeedSteps128}, Forward))
+	if p.String() != "11111111111111110000000110001111110111111110110000111" {
+		t.Error("Bad advanced speed packet: ", p.String())
+	}
+}
+
+func TestFunctionGroupPackets(t *testing.T) {
+	must := mustBuild(t)
+	addr := Address{Number: 3}
+
+	p := must(NewFunctionGroupTwoPacket(addr, true, false, false, true))
+	if len(p.data) != 1 || p.data[0] != 0xB9 { // 0b10111001
+		t.Errorf("bad function group two packet: %08b", p.data)
+	}
+
+	p = must(NewFunctionGroupThreePacket(addr, false, true, true, false))
+	if len(p.data) != 1 || p.data[0] != 0xA6 { // 0b10100110
+		t.Errorf("bad function group three packet: %08b", p.data)
+	}
+
+	p = must(NewFunctionsF13F20Packet(addr, 0x81))
+	if len(p.data) != 2 || p.data[0] != 0xDE || p.data[1] != 0x81 {
+		t.Errorf("bad F13-F20 packet: %08b", p.data)
+	}
+
+	p = must(NewFunctionsF21F28Packet(addr, 0x02))
+	if len(p.data) != 2 || p.data[0] != 0xDF || p.data[1] != 0x02 {
+		t.Errorf("bad F21-F28 packet: %08b", p.data)
+	}
+}
+
+func TestNewBinaryStatePacket(t *testing.T) {
+	must := mustBuild(t)
+	addr := Address{Number: 3}
+
+	p := must(NewBinaryStatePacket(addr, 29, true))
+	if len(p.data) != 2 || p.data[0] != 0xDD || p.data[1] != 0x9D {
+		t.Errorf("bad short form binary state packet: %08b", p.data)
+	}
+
+	p = must(NewBinaryStatePacket(addr, 300, false))
+	if len(p.data) != 3 || p.data[0] != 0xC0 || p.data[1] != 0x2C || p.data[2] != 0x02 {
+		t.Errorf("bad long form binary state packet: %08b", p.data)
+	}
+}
+
+func TestPOMPackets(t *testing.T) {
+	must := mustBuild(t)
+	addr := Address{Number: 3}
+
+	p := must(NewPOMWriteBytePacket(addr, 3, 25))
+	if len(p.data) != 3 || p.data[0] != 0xEC || p.data[1] != 0x02 || p.data[2] != 25 {
+		t.Errorf("bad write byte packet: %08b", p.data)
+	}
+
+	p = must(NewPOMWriteBytePacket(addr, 1024, 1))
+	if p.data[0] != 0xEF || p.data[1] != 0xFF {
+		t.Errorf("bad write byte packet for CV1024: %08b", p.data)
+	}
+
+	p = must(NewPOMWriteBitPacket(addr, 29, 5, true))
+	if len(p.data) != 3 || p.data[0] != 0xE8 || p.data[1] != 28 || p.data[2] != 0xFD {
+		t.Errorf("bad write bit packet: %08b", p.data)
+	}
+
+	p = must(NewPOMVerifyBytePacket(addr, 8, 0))
+	if len(p.data) != 3 || p.data[0] != 0xE4 || p.data[1] != 7 || p.data[2] != 0 {
+		t.Errorf("bad verify byte packet: %08b", p.data)
+	}
+}
+
+func TestServiceModePackets(t *testing.T) {
+	must := mustBuild(t)
+
+	p := NewServiceModeResetPacket()
+	if p.String() != "111111111111111111110000000000000000000000000001" {
+		t.Error("Bad service mode reset packet: ", p.String())
+	}
+
+	p = must(NewDirectWriteBytePacket(1, 3))
+	if len(p.address) != 0 || len(p.data) != 3 ||
+		p.data[0] != 0x7C || p.data[1] != 0 || p.data[2] != 3 || p.ecc != 0x7F {
+		t.Errorf("bad direct write byte packet: %08b", p.data)
+	}
+	if p.Length() != 20+4*9+1 {
+		t.Error("service mode packets should have a long preamble")
+	}
+
+	p = must(NewDirectVerifyBytePacket(29, 6))
+	if p.data[0] != 0x74 || p.data[1] != 28 || p.data[2] != 6 {
+		t.Errorf("bad direct verify byte packet: %08b", p.data)
+	}
+
+	p = must(NewDirectWriteBitPacket(29, 1, true))
+	if p.data[0] != 0x78 || p.data[1] != 28 || p.data[2] != 0xF9 {
+		t.Errorf("bad direct write bit packet: %08b", p.data)
+	}
+
+	p = must(NewDirectVerifyBitPacket(29, 7, false))
+	if p.data[0] != 0x78 || p.data[1] != 28 || p.data[2] != 0xE7 {
+		t.Errorf("bad direct verify bit packet: %08b", p.data)
+	}
+
+	p = must(NewRegisterWritePacket(PageRegister, 1))
+	if len(p.data) != 2 || p.data[0] != 0x7D || p.data[1] != 1 {
+		t.Errorf("bad register write packet: %08b", p.data)
+	}
+
+	p = must(NewRegisterVerifyPacket(1, 3))
+	if len(p.data) != 2 || p.data[0] != 0x70 || p.data[1] != 3 {
+		t.Errorf("bad register verify packet: %08b", p.data)
+	}
+}
+
+func TestNewBasicAccessoryPacket(t *testing.T) {
+	must := mustBuild(t)
+	p := must(NewBasicAccessoryPacket(1, 0, 0, true))
+	if p.String() != "11111111111111110100000010111110000011110011" {
+		t.Error("Bad basic accessory packet: ", p.String())
+	}
+
+	p = must(NewBasicAccessoryPacket(MaxAccessoryAddress, 3, 1, false))
+	if p.address[0] != 0xBF || p.data[0] != 0x87 { // 0b10111111 0b10000111
+		t.Errorf("bad basic accessory packet: %08b %08b", p.address, p.data)
+	}
+}
+
+func TestNewAccessoryOutputPacket(t *testing.T) {
+	must := mustBuild(t)
+	tcs := []struct {
+		addr    uint16
+		decoder uint16
+		pair    uint8
+	}{
+		{1, 1, 0},
+		{4, 1, 3},
+		{5, 2, 0},
+		{MaxAccessoryOutputAddress, 511, 3},
+	}
+	for _, tc := range tcs {
+		p := must(NewAccessoryOutputPacket(tc.addr, 1, true))
+		expected := must(NewBasicAccessoryPacket(tc.decoder, tc.pair, 1, true))
+		if p.String() != expected.String() {
+			t.Errorf("output %d should be decoder %d pair %d", tc.addr, tc.decoder, tc.pair)
+		}
+	}
+}
+
+func TestNewExtendedAccessoryPacket(t *testing.T) {
+	must := mustBuild(t)
+	p := must(NewExtendedAccessoryPacket(1, 0))
+	if p.address[0] != 0x81 || len(p.data) != 2 || p.data[0] != 0x71 || p.data[1] != 0 {
+		t.Errorf("bad extended accessory packet: %08b %08b", p.address, p.data)
+	}
+
+	p = must(NewExtendedAccessoryPacket(MaxAccessoryOutputAddress, 0x1F))
+	if p.address[0] != 0xBF || p.data[0] != 0x07 || p.data[1] != 0x1F {
+		t.Errorf("bad extended accessory packet: %08b %08b", p.address, p.data)
+	}
+}
+
+func TestNewConsistControlPacket(t *testing.T) {
+	must := mustBuild(t)
+	p := must(NewConsistControlPacket(Address{Number: 3}, 10, false))
+	if len(p.data) != 2 || p.data[0] != 0x12 || p.data[1] != 10 {
+		t.Errorf("bad consist control packet: %08b", p.data)
+	}
+
+	p = must(NewConsistControlPacket(Address{Number: 2045, Long: true}, 127, true))
+	if p.data[0] != 0x13 || p.data[1] != 127 {
+		t.Errorf("bad reversed consist control packet: %08b", p.data)
+	}
+}
+
+func TestDescribe(t *testing.T) {
+	must := mustBuild(t)
+	p := must(NewSpeedAndDirectionPacket(Address{Number: 3}, Speed{Step: 14}, Forward))
+	if p.Describe() != "loco 3 (short) speed 14/28 fwd" {
+		t.Error("bad description: ", p.Describe())
+	}
+
+	p = must(NewDirectWriteBytePacket(1, 3))
+	if p.Describe() != "service mode direct write CV1 = 3" {
+		t.Error("bad service mode description: ", p.Describe())
+	}
+
+	p = must(NewPacket(0x03, []byte{0xF0}))
+	if p.Describe() != "packet 03 f0 f3 (unknown instruction: f0)" {
+		t.Error("bad description of unknown packet: ", p.Describe())
+	}
+}
+
+// mustBuild returns a function which unwraps the results of packet
+// constructors, failing the test on errors.
+func mustBuild(t *testing.T) func(*Packet, error) *Packet {
+	return func(p *Packet, err error) *Packet {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+}
+
+func TestPacketErrors(t *testing.T) {
+	long := Address{Number: 2045, Long: true}
+	tcs := []struct {
+		name string
+		err  error
+		exp  error
+	}{
+		{"reserved address byte", second(NewPacket(0xF0, []byte{0})), ErrBadAddress},
+		{"long address first byte", second(NewPacket(0xC3, []byte{0x3F, 0x10})), ErrBadAddress},
+		{"no data", second(NewPacket(0x03, nil)), ErrBadLength},
+		{"long packet", second(NewAddressedPacket(long, []byte{0xC0, 0, 0, 0})), ErrBadLength},
+		{"short address", second(NewAddressedPacket(Address{Number: 128}, []byte{0x60})), ErrBadAddress},
+		{"long address", second(NewSpeedAndDirectionPacket(Address{Number: MaxLongAddress + 1, Long: true}, Speed{}, Forward)), ErrBadAddress},
+		{"decoder control", second(NewPacket(0x03, []byte{0x04})), ErrReservedInstruction},
+		{"consist control", second(NewPacket(0x03, []byte{0x10, 0x01})), ErrReservedInstruction},
+		{"advanced operations", second(NewAddressedPacket(long, []byte{0x30, 0x00})), ErrReservedInstruction},
+		{"feature expansion", second(NewAddressedPacket(long, []byte{0xD0, 0x00})), ErrReservedInstruction},
+		{"cv access", second(NewAddressedPacket(long, []byte{0xE0, 0x00, 0x00})), ErrReservedInstruction},
+		{"consist", second(NewConsistControlPacket(long, 128, false)), ErrBadValue},
+		{"binary state", second(NewBinaryStatePacket(long, 32768, true)), ErrBadValue},
+		{"cv 0", second(NewPOMWriteBytePacket(long, 0, 1)), ErrBadValue},
+		{"cv 1025", second(NewDirectVerifyBytePacket(1025, 1)), ErrBadValue},
+		{"bit", second(NewPOMWriteBitPacket(long, 1, 8, true)), ErrBadValue},
+		{"register", second(NewRegisterWritePacket(9, 1)), ErrBadValue},
+		{"accessory decoder", second(NewBasicAccessoryPacket(MaxAccessoryAddress+1, 0, 0, true)), ErrBadAddress},
+		{"accessory pair", second(NewBasicAccessoryPacket(1, 4, 0, true)), ErrBadValue},
+		{"accessory output 0", second(NewAccessoryOutputPacket(0, 0, true)), ErrBadAddress},
+		{"extended accessory", second(NewExtendedAccessoryPacket(MaxAccessoryOutputAddress+1, 0)), ErrBadAddress},
+	}
+	for _, tc := range tcs {
+		if !errors.Is(tc.err, tc.exp) {
+			t.Errorf("%s: expected %s, got %v", tc.name, tc.exp, tc.err)
+		}
+	}
+}
+
+func TestSendErrors(t *testing.T) {
+	p := NewBroadcastIdlePacket()
+	if err := p.Send(nil); !errors.Is(err, ErrNoDriver) {
+		t.Error("should fail without driver: ", err)
+	}
+	if err := PacketPause(nil); !errors.Is(err, ErrNoDriver) {
+		t.Error("should fail without driver: ", err)
+	}
+
+	defer func(d time.Duration) { BitZeroPartDuration = d }(BitZeroPartDuration)
+	BitZeroPartDuration = BitOnePartDuration
+	if err := p.Send(&dummy.DCCDummy{}); !errors.Is(err, ErrBadTiming) {
+		t.Error("should fail with bad timing: ", err)
+	}
+	if p.String() != "11111111111111110111111110000000000111111111" {
+		t.Error("String() should not depend on timing: ", p.String())
+	}
+}
+
+func TestBytes(t *testing.T) {
+	must := mustBuild(t)
+	p := must(NewSpeedAndDirectionPacket(Address{Number: 2045, Long: true}, Speed{Step: 1}, Backward))
+	b := p.Bytes()
+	if !bytes.Equal(b, []byte{0xC7, 0xFD, 0x42, 0x78}) {
+		t.Errorf("bad bytes: % x", b)
+	}
+	b[0] = 0
+	if p.Bytes()[0] != 0xC7 {
+		t.Error("Bytes() should return a copy")
+	}
+
+	b = must(NewDirectWriteBytePacket(1, 3)).Bytes()
+	if !bytes.Equal(b, []byte{0x7C, 0x00, 0x03, 0x7F}) {
+		t.Errorf("bad service mode bytes: % x", b)
+	}
+}
+
+func TestEqual(t *testing.T) {
+	must := mustBuild(t)
+	addr := Address{Number: 3}
+	p1 := must(NewFunctionGroupOnePacket(addr, true, false, false, false, false))
+	p2 := must(NewFunctionGroupOnePacket(addr, true, false, false, false, false))
+	p3 := must(NewFunctionGroupOnePacket(addr, false, false, false, false, false))
+	if !p1.Equal(p2) {
+		t.Error("packets should be equal")
+	}
+	if p1.Equal(p3) {
+		t.Error("packets should not be equal")
+	}
+
+	// Same bytes, different preamble.
+	if NewServiceModeResetPacket().Equal(NewBroadcastResetPacket()) {
+		t.Error("service mode and operations mode resets should differ")
+	}
+}
+
+// countDriver counts Low() and High() calls.
+type countDriver struct {
+	transitions int
+}
+
+func (d *countDriver) Low()       { d.transitions++ }
+func (d *countDriver) High()      { d.transitions++ }
+func (d *countDriver) TracksOn()  {}
+func (d *countDriver) TracksOff() {}
+
+// waveformDriver records the waveforms sent to it.
+type waveformDriver struct {
+	countDriver
+	waveforms [][]time.Duration
+}
+
+func (d *waveformDriver) SendWaveform(halfBits []time.Duration) error {
+	d.waveforms = append(d.waveforms, halfBits)
+	return nil
+}
+
+func TestSendSeveralDrivers(t *testing.T) {
+	p := NewBroadcastIdlePacket()
+	d1 := &countDriver{}
+	d2 := &countDriver{}
+
+	var wg sync.WaitGroup
+	for _, d := range []Driver{d1, d2} {
+		wg.Add(1)
+		go func(d Driver) {
+			defer wg.Done()
+			if err := p.Send(d); err != nil {
+				t.Error(err)
+			}
+		}(d)
+	}
+	wg.Wait()
+
+	for _, d := range []*countDriver{d1, d2} {
+		if d.transitions != 2*p.Length() {
+			t.Errorf("expected %d transitions, got %d", 2*p.Length(), d.transitions)
+		}
+	}
+}
+
+// second returns the error from a packet constructor.
+func second(p *Packet, err error) error {
+	return err
+}
+
+func TestWaveform(t *testing.T) {
+	p := NewBroadcastIdlePacket()
+	halfBits, err := p.Waveform()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(halfBits) != 2*p.Length() {
+		t.Fatal("bad waveform length: ", len(halfBits))
+	}
+	for i, bit := range p.String() {
+		expected := BitZeroPartDuration
+		if bit == '1' {
+			expected = BitOnePartDuration
+		}
+		if halfBits[2*i] != expected || halfBits[2*i+1] != expected {
+			t.Errorf("bad duration for bit %d", i)
+		}
+	}
+
+	d := &waveformDriver{}
+	if err := p.Send(d); err != nil {
+		t.Fatal(err)
+	}
+	if len(d.waveforms) != 1 || !reflect.DeepEqual(d.waveforms[0], halfBits) {
+		t.Error("should have sent the waveform")
+	}
+	if d.transitions != 0 {
+		t.Error("should not use Low() and High() with a WaveformDriver")
+	}
+}
+
+// cutoutDriver records when the RailCom cutout starts and ends.
+type cutoutDriver struct {
+	countDriver
+	clk        clock.Virtual
+	start, end time.Time
+}
+
+func (d *cutoutDriver) Clock() clock.Clock { return &d.clk }
+func (d *cutoutDriver) CutoutStart()       { d.start = d.clk.Now() }
+func (d *cutoutDriver) CutoutEnd()         { d.end = d.clk.Now() }
+
+func TestRailComCutout(t *testing.T) {
+	d := &cutoutDriver{}
+	if err := RailComCutout(d); err != nil {
+		t.Fatal(err)
+	}
+	if d.start.Sub(time.Time{}) != RailComCutoutStart || d.end.Sub(time.Time{}) != RailComCutoutEnd {
+		t.Errorf("bad cutout: %s to %s", d.start.Sub(time.Time{}), d.end.Sub(time.Time{}))
+	}
+	if RailComCutoutStart < RailComCutoutStartMin || RailComCutoutStart > RailComCutoutStartMax ||
+		RailComCutoutEnd < RailComCutoutEndMin || RailComCutoutEnd > RailComCutoutEndMax {
+		t.Error("default cutout timing should follow the standard")
+	}
+
+	if err := RailComCutout(nil); !errors.Is(err, ErrNoDriver) {
+		t.Error("should fail without driver: ", err)
+	}
+	if err := RailComCutout(&countDriver{}); !errors.Is(err, ErrNoCutout) {
+		t.Error("should fail without cutout support: ", err)
+	}
+
+	defer func(d time.Duration) { RailComCutoutEnd = d }(RailComCutoutEnd)
+	RailComCutoutEnd = RailComCutoutStart
+	if err := RailComCutout(d); !errors.Is(err, ErrBadTiming) {
+		t.Error("should fail with bad timing: ", err)
+	}
+}
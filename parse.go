@@ -0,0 +1,686 @@
+package dcc
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Acceptance limits used when parsing packets. They follow the S-9.1 and
+// S-9.2 requirements for decoders, which are more tolerant than the
+// ones for command stations.
+const (
+	parseBitOneMin      = 52 * time.Microsecond
+	parseBitOneMax      = 64 * time.Microsecond
+	parseBitZeroMin     = 90 * time.Microsecond
+	parseBitZeroMax     = 10000 * time.Microsecond
+	parseHalfBitMaxDiff = 6 * time.Microsecond
+	parsePreambleBitMin = 10
+)
+
+// Errors returned when parsing packets. They are wrapped with details
+// about the problem, so use errors.Is to check for them.
+var (
+	// ErrBadPreamble is returned when a packet does not start with
+	// enough preamble bits.
+	ErrBadPreamble = errors.New("bad preamble")
+	// ErrBadFraming is returned when the start, end or data bits of a
+	// packet cannot be read, or when a packet has the wrong number of
+	// bytes for its instruction.
+	ErrBadFraming = errors.New("bad framing")
+	// ErrBadChecksum is returned when the error detection byte does
+	// not match the rest of the packet.
+	ErrBadChecksum = errors.New("bad error detection byte")
+	// ErrUnknownInstruction is returned for well-formed packets with
+	// reserved or unsupported addresses and instructions.
+	ErrUnknownInstruction = errors.New("unknown instruction")
+)
+
+// Instruction is a decoded DCC packet, as returned by ParsePacket and
+// related functions. The concrete type depends on the instruction:
+// IdleInstruction, ResetInstruction, SpeedInstruction,
+// FunctionInstruction, BinaryStateInstruction, ConsistControlInstruction,
+// CVInstruction, RegisterInstruction, BasicAccessoryInstruction or
+// ExtendedAccessoryInstruction.
+type Instruction interface {
+	String() string
+}
+
+// IdleInstruction is the broadcast idle packet.
+type IdleInstruction struct{}
+
+func (i IdleInstruction) String() string {
+	return "idle"
+}
+
+// ResetInstruction asks decoders to return to their power-up state. The
+// zero Address is the broadcast reset, which is also the service mode
+// reset packet.
+type ResetInstruction struct {
+	Address Address
+}
+
+func (i ResetInstruction) String() string {
+	if isBroadcast(i.Address) {
+		return "reset"
+	}
+	return locoName(i.Address) + " reset"
+}
+
+// SpeedInstruction sets the speed and direction of a multi-function
+// decoder. Baseline speed instructions are decoded in 28-step mode, since
+// the packet does not tell 14 and 28-step modes apart.
+type SpeedInstruction struct {
+	Address   Address
+	Speed     Speed
+	Direction Direction
+}
+
+func (i SpeedInstruction) String() string {
+	var speed string
+	switch {
+	case i.Speed.EStop:
+		speed = "estop"
+	case i.Speed.Step == 0:
+		speed = "stop"
+	default:
+		speed = fmt.Sprintf("speed %d/%d", i.Speed.Step, i.Speed.Steps)
+	}
+	return fmt.Sprintf("%s %s %s", locoName(i.Address), speed,
+		dirName(i.Direction))
+}
+
+// FunctionInstruction sets the state of a group of functions of a
+// multi-function decoder. States[0] holds the state of function First.
+// F0 corresponds to FL.
+type FunctionInstruction struct {
+	Address Address
+	First   uint8
+	States  []bool
+}
+
+func (i FunctionInstruction) String() string {
+	var on []string
+	for n, s := range i.States {
+		if s {
+			on = append(on, fmt.Sprintf("F%d", int(i.First)+n))
+		}
+	}
+	fns := "off"
+	if len(on) > 0 {
+		fns = "on " + strings.Join(on, " ")
+	}
+	return fmt.Sprintf("%s F%d-F%d %s", locoName(i.Address), i.First,
+		int(i.First)+len(i.States)-1, fns)
+}
+
+// BinaryStateInstruction sets a binary state (i.e. F29-F68) of a
+// multi-function decoder.
+type BinaryStateInstruction struct {
+	Address Address
+	State   uint16
+	On      bool
+}
+
+func (i BinaryStateInstruction) String() string {
+	return fmt.Sprintf("%s binary state %d %s", locoName(i.Address),
+		i.State, onOff(i.On))
+}
+
+// ConsistControlInstruction places a multi-function decoder in an
+// advanced consist. Consist 0 removes it from the consist.
+type ConsistControlInstruction struct {
+	Address  Address
+	Consist  uint8
+	Reversed bool
+}
+
+func (i ConsistControlInstruction) String() string {
+	dir := "normal"
+	if i.Reversed {
+		dir = "reversed"
+	}
+	return fmt.Sprintf("%s consist %d %s", locoName(i.Address),
+		i.Consist, dir)
+}
+
+// CVOperation identifies the operation of a CVInstruction.
+type CVOperation uint8
+
+// CV operations.
+const (
+	CVVerifyByte CVOperation = iota + 1
+	CVWriteByte
+	CVVerifyBit
+	CVWriteBit
+)
+
+func (op CVOperation) String() string {
+	switch op {
+	case CVVerifyByte, CVVerifyBit:
+		return "verify"
+	case CVWriteByte, CVWriteBit:
+		return "write"
+	default:
+		return "unknown"
+	}
+}
+
+// CVInstruction accesses a configuration variable (1-1024) of a
+// multi-function decoder, either in operations mode or, when Service is
+// set, in service mode direct addressing. For bit operations, Bit holds
+// the bit position (0-7) and Value its value (0 or 1).
+type CVInstruction struct {
+	Address Address
+	Service bool
+	Op      CVOperation
+	CV      uint16
+	Bit     uint8
+	Value   byte
+}
+
+func (i CVInstruction) String() string {
+	target := locoName(i.Address) + " POM"
+	if i.Service {
+		target = "service mode direct"
+	}
+	cv := fmt.Sprintf("CV%d", i.CV)
+	if i.Op == CVVerifyBit || i.Op == CVWriteBit {
+		cv += fmt.Sprintf(" bit %d", i.Bit)
+	}
+	return fmt.Sprintf("%s %s %s = %d", target, i.Op, cv, i.Value)
+}
+
+// RegisterInstruction accesses a decoder register (1-8) in service mode
+// physical register or paged addressing.
+type RegisterInstruction struct {
+	Write    bool
+	Register uint8
+	Value    byte
+}
+
+func (i RegisterInstruction) String() string {
+	op := "verify"
+	if i.Write {
+		op = "write"
+	}
+	return fmt.Sprintf("service mode register %s R%d = %d", op,
+		i.Register, i.Value)
+}
+
+// BasicAccessoryInstruction sets the state of an output of a basic
+// accessory decoder (0-511).
+type BasicAccessoryInstruction struct {
+	Decoder  uint16
+	Pair     uint8
+	Output   uint8
+	Activate bool
+}
+
+// OutputAddress returns the accessory output address (1-2044)
+// as used by NewAccessoryOutputPacket, or 0 for decoder 0.
+func (i BasicAccessoryInstruction) OutputAddress() uint16 {
+	return outputAddress(i.Decoder, i.Pair)
+}
+
+func (i BasicAccessoryInstruction) String() string {
+	return fmt.Sprintf("%s output %d %s",
+		accessoryName(i.Decoder, i.Pair), i.Output, onOff(i.Activate))
+}
+
+// ExtendedAccessoryInstruction sets the aspect of an extended accessory
+// decoder.
+type ExtendedAccessoryInstruction struct {
+	Decoder uint16
+	Pair    uint8
+	Aspect  byte
+}
+
+// OutputAddress returns the accessory output address (1-2044)
+// as used by NewExtendedAccessoryPacket, or 0 for decoder 0.
+func (i ExtendedAccessoryInstruction) OutputAddress() uint16 {
+	return outputAddress(i.Decoder, i.Pair)
+}
+
+func (i ExtendedAccessoryInstruction) String() string {
+	return fmt.Sprintf("%s aspect %d",
+		accessoryName(i.Decoder, i.Pair), i.Aspect)
+}
+
+func isBroadcast(a Address) bool {
+	return !a.Long && a.Number == 0
+}
+
+func locoName(a Address) string {
+	switch {
+	case isBroadcast(a):
+		return "all locos"
+	case a.Long:
+		return fmt.Sprintf("loco %d (long)", a.Number)
+	default:
+		return fmt.Sprintf("loco %d (short)", a.Number)
+	}
+}
+
+func dirName(d Direction) string {
+	if d == Forward {
+		return "fwd"
+	}
+	return "rev"
+}
+
+func onOff(on bool) string {
+	if on {
+		return "on"
+	}
+	return "off"
+}
+
+func outputAddress(decoder uint16, pair uint8) uint16 {
+	if decoder == 0 {
+		return 0
+	}
+	return (decoder-1)*4 + uint16(pair) + 1
+}
+
+func accessoryName(decoder uint16, pair uint8) string {
+	if decoder == 0 {
+		return fmt.Sprintf("accessory decoder 0 pair %d", pair)
+	}
+	return fmt.Sprintf("accessory %d", outputAddress(decoder, pair))
+}
+
+// ParsePacket decodes a packet from its bit string representation, as
+// returned by Packet.String(). It checks the preamble, the start and end
+// bits and the error detection byte, and decodes the instruction as an
+// operations mode packet.
+func ParsePacket(bits string) (Instruction, error) {
+	frame, err := parseBits(bits)
+	if err != nil {
+		return nil, err
+	}
+	return ParseFrame(frame)
+}
+
+// ParseDurations decodes a packet from the durations of the halves of
+// each of its bits (the time the signal stays low followed by the time
+// it stays high), like those returned by Packet.Waveform() and sent by
+// a WaveformDriver. Both halves of a bit must have the same duration,
+// within the tolerance allowed for decoders. See ParsePacket.
+func ParseDurations(halfBits []time.Duration) (Instruction, error) {
+	if len(halfBits)%2 != 0 {
+		return nil, fmt.Errorf("%w: odd number of half bits (%d)",
+			ErrBadFraming, len(halfBits))
+	}
+	bits := make([]byte, len(halfBits)/2)
+	for i := range bits {
+		low, high := halfBits[2*i], halfBits[2*i+1]
+		diff := low - high
+		if diff < 0 {
+			diff = -diff
+		}
+		if diff > parseHalfBitMaxDiff {
+			return nil, fmt.Errorf("%w: bit %d: halves of %s and %s are not symmetric",
+				ErrBadFraming, i, low, high)
+		}
+		switch {
+		case low >= parseBitOneMin && low <= parseBitOneMax &&
+			high >= parseBitOneMin && high <= parseBitOneMax:
+			bits[i] = '1'
+		case low >= parseBitZeroMin && low <= parseBitZeroMax &&
+			high >= parseBitZeroMin && high <= parseBitZeroMax:
+			bits[i] = '0'
+		default:
+			return nil, fmt.Errorf("%w: bit %d: duration %s is neither a 1 nor a 0",
+				ErrBadFraming, i, low)
+		}
+	}
+	return ParsePacket(string(bits))
+}
+
+// ParseFrame decodes an operations mode packet from its bytes: the
+// address, the instruction bytes and the error detection byte.
+func ParseFrame(frame []byte) (Instruction, error) {
+	b, err := checkFrame(frame)
+	if err != nil {
+		return nil, err
+	}
+
+	switch a := b[0]; {
+	case a == 0xFF:
+		if len(b) != 2 || b[1] != 0 {
+			return nil, fmt.Errorf("%w: idle packet with data % x",
+				ErrUnknownInstruction, b[1:])
+		}
+		return IdleInstruction{}, nil
+	case a <= 0x7F: // 0b0AAAAAAA: short and broadcast addresses
+		return parseMultiFunction(Address{Number: uint16(a)}, b[1:])
+	case a <= 0xBF: // 0b10AAAAAA
+		return parseAccessory(b)
+	case a <= 0xE7: // 0b11AAAAAA up to address 10239
+		if len(b) < 3 {
+			return nil, fmt.Errorf("%w: long address without instruction",
+				ErrBadFraming)
+		}
+		addr := Address{
+			Number: uint16(a&0x3F)<<8 | uint16(b[1]),
+			Long:   true,
+		}
+		return parseMultiFunction(addr, b[2:])
+	default:
+		return nil, fmt.Errorf("%w: reserved address byte %#02x",
+			ErrUnknownInstruction, a)
+	}
+}
+
+// ParseServiceModeFrame decodes a service mode packet from its bytes. In
+// service mode packets have no address, and their instructions overlap
+// with operations mode packets for addresses 112-127, so they must be
+// parsed separately.
+func ParseServiceModeFrame(frame []byte) (Instruction, error) {
+	b, err := checkFrame(frame)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case len(b) == 2 && b[0] == 0 && b[1] == 0:
+		return ResetInstruction{}, nil
+	case b[0]&0xF0 != 0x70: // 0b0111xxxx
+		return nil, fmt.Errorf("%w: %#02x is not a service mode instruction",
+			ErrUnknownInstruction, b[0])
+	case len(b) == 3:
+		return parseCV(Address{}, true, b)
+	case len(b) == 2:
+		return RegisterInstruction{
+			Write:    b[0]&0x08 != 0,
+			Register: b[0]&0x07 + 1,
+			Value:    b[1],
+		}, nil
+	default:
+		return nil, fmt.Errorf("%w: service mode instruction with %d bytes",
+			ErrBadFraming, len(b))
+	}
+}
+
+// parseBits converts a bit string into a frame.
+func parseBits(bits string) ([]byte, error) {
+	preamble := strings.IndexByte(bits, '0')
+	if preamble < 0 {
+		preamble = len(bits)
+	}
+	if preamble < parsePreambleBitMin {
+		return nil, fmt.Errorf("%w: %d bits, at least %d required",
+			ErrBadPreamble, preamble, parsePreambleBitMin)
+	}
+
+	var frame []byte
+	i := preamble
+	for {
+		if i >= len(bits) {
+			return nil, fmt.Errorf("%w: missing packet end bit", ErrBadFraming)
+		}
+		switch bits[i] {
+		case '0': // start bit
+		case '1':
+			if rest := len(bits) - i - 1; rest > 0 {
+				return nil, fmt.Errorf("%w: %d bits after packet end bit",
+					ErrBadFraming, rest)
+			}
+			return frame, nil
+		default:
+			return nil, fmt.Errorf("%w: bit %d: invalid character %q",
+				ErrBadFraming, i, bits[i])
+		}
+
+		if i+8 >= len(bits) {
+			return nil, fmt.Errorf("%w: bit %d: truncated byte",
+				ErrBadFraming, i+1)
+		}
+		var b byte
+		for j := i + 1; j <= i+8; j++ {
+			switch bits[j] {
+			case '0':
+				b = b << 1
+			case '1':
+				b = b<<1 | 1
+			default:
+				return nil, fmt.Errorf("%w: bit %d: invalid character %q",
+					ErrBadFraming, j, bits[j])
+			}
+		}
+		frame = append(frame, b)
+		i += 9
+	}
+}
+
+// checkFrame verifies the error detection byte of a frame and returns
+// the rest of it.
+func checkFrame(frame []byte) ([]byte, error) {
+	if len(frame) < 3 {
+		return nil, fmt.Errorf("%w: %d bytes, at least 3 required",
+			ErrBadFraming, len(frame))
+	}
+	last := len(frame) - 1
+	var ecc byte
+	for _, b := range frame[:last] {
+		ecc = ecc ^ b
+	}
+	if ecc != frame[last] {
+		return nil, fmt.Errorf("%w: got %#02x, expected %#02x",
+			ErrBadChecksum, frame[last], ecc)
+	}
+	return frame[:last], nil
+}
+
+// instructionLength checks that an instruction has n bytes.
+func instructionLength(d []byte, n int) error {
+	if len(d) != n {
+		return fmt.Errorf("%w: instruction %#02x has %d bytes, expected %d",
+			ErrBadFraming, d[0], len(d), n)
+	}
+	return nil
+}
+
+func unknownInstruction(d []byte) error {
+	return fmt.Errorf("%w: % x", ErrUnknownInstruction, d)
+}
+
+// parseMultiFunction decodes the instruction bytes of a packet for a
+// multi-function decoder.
+func parseMultiFunction(addr Address, d []byte) (Instruction, error) {
+	if len(d) == 0 {
+		return nil, fmt.Errorf("%w: missing instruction", ErrBadFraming)
+	}
+
+	bits := func(b byte, n int) []bool {
+		states := make([]bool, n)
+		for i := range states {
+			states[i] = b&(1<<uint(i)) != 0
+		}
+		return states
+	}
+
+	switch d[0] >> 5 {
+	case 0x0: // 0b000: decoder and consist control
+		switch {
+		case d[0] == 0x00:
+			if err := instructionLength(d, 1); err != nil {
+				return nil, err
+			}
+			return ResetInstruction{Address: addr}, nil
+		case d[0]&0xFE == 0x12:
+			if err := instructionLength(d, 2); err != nil {
+				return nil, err
+			}
+			return ConsistControlInstruction{
+				Address:  addr,
+				Consist:  d[1] & 0x7F,
+				Reversed: d[0]&0x01 != 0,
+			}, nil
+		}
+	case 0x1: // 0b001: advanced operations
+		if d[0] == 0x3F {
+			if err := instructionLength(d, 2); err != nil {
+				return nil, err
+			}
+			return SpeedInstruction{
+				Address:   addr,
+				Speed:     advancedSpeed(d[1] & 0x7F),
+				Direction: Direction(d[1] >> 7),
+			}, nil
+		}
+	case 0x2, 0x3: // 0b01D: baseline speed and direction
+		if err := instructionLength(d, 1); err != nil {
+			return nil, err
+		}
+		return SpeedInstruction{
+			Address:   addr,
+			Speed:     baselineSpeed(d[0] & 0x1F),
+			Direction: Direction(d[0]>>5) & 0x1,
+		}, nil
+	case 0x4: // 0b100: function group one
+		if err := instructionLength(d, 1); err != nil {
+			return nil, err
+		}
+		states := append([]bool{d[0]&0x10 != 0}, bits(d[0], 4)...)
+		return FunctionInstruction{Address: addr, First: 0, States: states}, nil
+	case 0x5: // 0b101: function group two
+		if err := instructionLength(d, 1); err != nil {
+			return nil, err
+		}
+		first := uint8(9)
+		if d[0]&0x10 != 0 {
+			first = 5
+		}
+		return FunctionInstruction{Address: addr, First: first, States: bits(d[0], 4)}, nil
+	case 0x6: // 0b110: feature expansion
+		switch d[0] {
+		case 0xDE, 0xDF:
+			if err := instructionLength(d, 2); err != nil {
+				return nil, err
+			}
+			first := uint8(13)
+			if d[0] == 0xDF {
+				first = 21
+			}
+			return FunctionInstruction{Address: addr, First: first, States: bits(d[1], 8)}, nil
+		case 0xDD:
+			if err := instructionLength(d, 2); err != nil {
+				return nil, err
+			}
+			return BinaryStateInstruction{
+				Address: addr,
+				State:   uint16(d[1] & 0x7F),
+				On:      d[1]&0x80 != 0,
+			}, nil
+		case 0xC0:
+			if err := instructionLength(d, 3); err != nil {
+				return nil, err
+			}
+			return BinaryStateInstruction{
+				Address: addr,
+				State:   uint16(d[2])<<7 | uint16(d[1]&0x7F),
+				On:      d[1]&0x80 != 0,
+			}, nil
+		}
+	case 0x7: // 0b111: configuration variable access
+		if d[0]&0xF0 == 0xE0 { // long form
+			if err := instructionLength(d, 3); err != nil {
+				return nil, err
+			}
+			return parseCV(addr, false, d)
+		}
+	}
+	return nil, unknownInstruction(d)
+}
+
+// baselineSpeed decodes the 5 CSSSS speed bits of the baseline speed and
+// direction instruction in 28-step mode.
+func baselineSpeed(b byte) Speed {
+	v := (b&0x0F)<<1 | b>>4
+	switch {
+	case v <= 1:
+		return Speed{Steps: SpeedSteps28}
+	case v <= 3:
+		return Speed{Steps: SpeedSteps28, EStop: true}
+	default:
+		return Speed{Step: v - 3, Steps: SpeedSteps28}
+	}
+}
+
+// advancedSpeed decodes the 7 speed bits of the 128 speed step control
+// instruction.
+func advancedSpeed(b byte) Speed {
+	switch b {
+	case 0:
+		return Speed{Steps: SpeedSteps128}
+	case 1:
+		return Speed{Steps: SpeedSteps128, EStop: true}
+	default:
+		return Speed{Step: b - 1, Steps: SpeedSteps128}
+	}
+}
+
+// parseCV decodes the long form of the configuration variable access
+// instruction, which is shared by operations mode and service mode
+// direct addressing: xxxxCCVV VVVVVVVV DDDDDDDD.
+func parseCV(addr Address, service bool, d []byte) (Instruction, error) {
+	cv := CVInstruction{
+		Address: addr,
+		Service: service,
+		CV:      (uint16(d[0]&0x3)<<8 | uint16(d[1])) + 1,
+	}
+	switch (d[0] >> 2) & 0x3 {
+	case cvVerifyByte:
+		cv.Op = CVVerifyByte
+		cv.Value = d[2]
+	case cvWriteByte:
+		cv.Op = CVWriteByte
+		cv.Value = d[2]
+	case cvBitManip:
+		if d[2]&0xE0 != 0xE0 { // 0b111KDBBB
+			return nil, unknownInstruction(d)
+		}
+		cv.Op = CVVerifyBit
+		if d[2]&0x10 != 0 {
+			cv.Op = CVWriteBit
+		}
+		cv.Bit = d[2] & 0x7
+		cv.Value = (d[2] >> 3) & 0x1
+	default:
+		return nil, unknownInstruction(d)
+	}
+	return cv, nil
+}
+
+// parseAccessory decodes basic and extended accessory decoder packets.
+func parseAccessory(b []byte) (Instruction, error) {
+	a, d := b[0], b[1]
+	high := ^d >> 4 & 0x7
+	if d&0x80 != 0 { // basic: 10AAAAAA 1AAACDDD
+		if err := instructionLength(b, 2); err != nil {
+			return nil, err
+		}
+		return BasicAccessoryInstruction{
+			Decoder:  uint16(high)<<6 | uint16(a&0x3F),
+			Pair:     (d >> 1) & 0x3,
+			Output:   d & 0x1,
+			Activate: d&0x08 != 0,
+		}, nil
+	}
+
+	if d&0x09 != 0x01 { // extended: 10AAAAAA 0AAA0AA1 DDDDDDDD
+		return nil, unknownInstruction(b)
+	}
+	if err := instructionLength(b, 3); err != nil {
+		return nil, err
+	}
+	raw := uint16(high)<<8 | uint16(a&0x3F)<<2 | uint16(d>>1&0x3)
+	return ExtendedAccessoryInstruction{
+		Decoder: raw >> 2,
+		Pair:    uint8(raw & 0x3),
+		Aspect:  b[2],
+	}, nil
+}
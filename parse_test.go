@@ -0,0 +1,228 @@
+package dcc
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParsePacket(t *testing.T) {
+	must := mustBuild(t)
+	short := Address{Number: 3}
+	long := Address{Number: 2045, Long: true}
+
+	tcs := []struct {
+		p *Packet
+		i Instruction
+	}{
+		{NewBroadcastIdlePacket(), IdleInstruction{}},
+		{NewBroadcastResetPacket(), ResetInstruction{}},
+		{
+			NewBroadcastStopPacket(Forward, false, true),
+			SpeedInstruction{Speed: Speed{Steps: SpeedSteps28, EStop: true}, Direction: Forward},
+		},
+		{
+			must(NewSpeedAndDirectionPacket(short, Speed{Step: 14}, Forward)),
+			SpeedInstruction{short, Speed{Step: 14, Steps: SpeedSteps28}, Forward},
+		},
+		{
+			must(NewSpeedAndDirectionPacket(long, Speed{Step: 100, Steps: SpeedSteps128}, Backward)),
+			SpeedInstruction{long, Speed{Step: 100, Steps: SpeedSteps128}, Backward},
+		},
+		{
+			must(NewFunctionGroupOnePacket(short, true, false, true, false, false)),
+			FunctionInstruction{short, 0, []bool{true, false, true, false, false}},
+		},
+		{
+			must(NewFunctionGroupTwoPacket(short, false, true, false, false)),
+			FunctionInstruction{short, 5, []bool{false, true, false, false}},
+		},
+		{
+			must(NewFunctionGroupThreePacket(short, false, false, false, true)),
+			FunctionInstruction{short, 9, []bool{false, false, false, true}},
+		},
+		{
+			must(NewFunctionsF13F20Packet(long, 0x81)),
+			FunctionInstruction{long, 13, []bool{true, false, false, false, false, false, false, true}},
+		},
+		{
+			must(NewFunctionsF21F28Packet(short, 0x02)),
+			FunctionInstruction{short, 21, []bool{false, true, false, false, false, false, false, false}},
+		},
+		{must(NewBinaryStatePacket(short, 29, true)), BinaryStateInstruction{short, 29, true}},
+		{must(NewBinaryStatePacket(long, 300, false)), BinaryStateInstruction{long, 300, false}},
+		{must(NewConsistControlPacket(short, 10, true)), ConsistControlInstruction{short, 10, true}},
+		{
+			must(NewPOMWriteBytePacket(long, 1024, 7)),
+			CVInstruction{Address: long, Op: CVWriteByte, CV: 1024, Value: 7},
+		},
+		{
+			must(NewPOMVerifyBytePacket(short, 1, 3)),
+			CVInstruction{Address: short, Op: CVVerifyByte, CV: 1, Value: 3},
+		},
+		{
+			must(NewPOMWriteBitPacket(short, 29, 5, true)),
+			CVInstruction{Address: short, Op: CVWriteBit, CV: 29, Bit: 5, Value: 1},
+		},
+		{
+			must(NewAccessoryOutputPacket(12, 1, true)),
+			BasicAccessoryInstruction{Decoder: 3, Pair: 3, Output: 1, Activate: true},
+		},
+		{
+			must(NewBasicAccessoryPacket(MaxAccessoryAddress, 2, 0, false)),
+			BasicAccessoryInstruction{Decoder: MaxAccessoryAddress, Pair: 2},
+		},
+		{
+			must(NewExtendedAccessoryPacket(MaxAccessoryOutputAddress, 8)),
+			ExtendedAccessoryInstruction{Decoder: 511, Pair: 3, Aspect: 8},
+		},
+	}
+
+	for _, tc := range tcs {
+		i, err := ParsePacket(tc.p.String())
+		if err != nil {
+			t.Errorf("%s: %s", tc.p, err)
+			continue
+		}
+		if !reflect.DeepEqual(i, tc.i) {
+			t.Errorf("parsed %#v, expected %#v", i, tc.i)
+		}
+	}
+}
+
+func TestParseDurations(t *testing.T) {
+	must := mustBuild(t)
+	p := must(NewFunctionGroupOnePacket(Address{Number: 5}, true, false, false, false, false))
+	halfBits, err := p.Waveform()
+	if err != nil {
+		t.Fatal(err)
+	}
+	i, err := ParseDurations(halfBits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if i.String() != "loco 5 (short) F0-F4 on F0" {
+		t.Error("bad instruction: ", i)
+	}
+
+	bad := func(desc string, f func(halfBits []time.Duration) []time.Duration) {
+		t.Helper()
+		hb := f(append([]time.Duration(nil), halfBits...))
+		if _, err := ParseDurations(hb); !errors.Is(err, ErrBadFraming) {
+			t.Errorf("should fail with %s: %v", desc, err)
+		}
+	}
+	bad("ambiguous bits", func(hb []time.Duration) []time.Duration {
+		hb[40], hb[41] = 75*time.Microsecond, 75*time.Microsecond
+		return hb
+	})
+	bad("asymmetric halves", func(hb []time.Duration) []time.Duration {
+		hb[40], hb[41] = 52*time.Microsecond, 64*time.Microsecond
+		return hb
+	})
+	bad("odd number of halves", func(hb []time.Duration) []time.Duration {
+		return hb[:len(hb)-1]
+	})
+}
+
+func TestParseServiceModeFrame(t *testing.T) {
+	must := mustBuild(t)
+	tcs := []struct {
+		p *Packet
+		i Instruction
+	}{
+		{NewServiceModeResetPacket(), ResetInstruction{}},
+		{
+			must(NewDirectWriteBytePacket(29, 6)),
+			CVInstruction{Service: true, Op: CVWriteByte, CV: 29, Value: 6},
+		},
+		{
+			must(NewDirectVerifyBitPacket(8, 7, false)),
+			CVInstruction{Service: true, Op: CVVerifyBit, CV: 8, Bit: 7},
+		},
+		{must(NewRegisterWritePacket(PageRegister, 1)), RegisterInstruction{true, PageRegister, 1}},
+		{must(NewRegisterVerifyPacket(1, 3)), RegisterInstruction{false, 1, 3}},
+	}
+
+	for _, tc := range tcs {
+		i, err := ParseServiceModeFrame(tc.p.Bytes())
+		if err != nil {
+			t.Errorf("%s: %s", tc.p, err)
+			continue
+		}
+		if !reflect.DeepEqual(i, tc.i) {
+			t.Errorf("parsed %#v, expected %#v", i, tc.i)
+		}
+	}
+
+	_, err := ParseServiceModeFrame(NewBroadcastIdlePacket().Bytes())
+	if !errors.Is(err, ErrUnknownInstruction) {
+		t.Error("idle is not a service mode instruction: ", err)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	idle := NewBroadcastIdlePacket().String()
+
+	tcs := []struct {
+		bits string
+		err  error
+	}{
+		{idle[7:], ErrBadPreamble},
+		{idle[:len(idle)-1], ErrBadFraming},
+		{idle + "1", ErrBadFraming},
+		{idle[:20] + "x" + idle[21:], ErrBadFraming},
+		{idle[:len(idle)-2] + "01", ErrBadChecksum},
+		{"11111111111111110000000000000000001", ErrBadFraming},
+	}
+	for _, tc := range tcs {
+		_, err := ParsePacket(tc.bits)
+		if !errors.Is(err, tc.err) {
+			t.Errorf("%s: expected %s, got %v", tc.bits, tc.err, err)
+		}
+	}
+
+	frameErrors := []struct {
+		frame []byte
+		err   error
+	}{
+		{[]byte{0xE8, 0x00, 0xE8}, ErrUnknownInstruction},     // reserved address
+		{[]byte{0x03, 0x30, 0x33}, ErrUnknownInstruction},     // reserved instruction
+		{[]byte{0x03, 0x3F, 0x3C}, ErrBadFraming},             // missing speed byte
+		{[]byte{0x03, 0x40, 0x00, 0x43}, ErrBadFraming},       // extra byte
+		{[]byte{0x81, 0x71, 0x00, 0x00, 0xF0}, ErrBadFraming}, // long extended accessory
+	}
+	for _, tc := range frameErrors {
+		_, err := ParseFrame(tc.frame)
+		if !errors.Is(err, tc.err) {
+			t.Errorf("% x: expected %s, got %v", tc.frame, tc.err, err)
+		}
+	}
+}
+
+func TestInstructionString(t *testing.T) {
+	must := mustBuild(t)
+	tcs := []struct {
+		p   *Packet
+		str string
+	}{
+		{must(NewSpeedAndDirectionPacket(Address{Number: 3}, Speed{Step: 14}, Forward)), "loco 3 (short) speed 14/28 fwd"},
+		{must(NewSpeedAndDirectionPacket(Address{Number: 2045, Long: true}, Speed{}, Backward)), "loco 2045 (long) stop rev"},
+		{NewBroadcastStopPacket(Forward, false, true), "all locos estop fwd"},
+		{must(NewFunctionGroupTwoPacket(Address{Number: 3}, false, false, false, false)), "loco 3 (short) F5-F8 off"},
+		{must(NewPOMWriteBitPacket(Address{Number: 3}, 29, 1, true)), "loco 3 (short) POM write CV29 bit 1 = 1"},
+		{must(NewAccessoryOutputPacket(12, 1, true)), "accessory 12 output 1 on"},
+		{must(NewExtendedAccessoryPacket(20, 4)), "accessory 20 aspect 4"},
+		{NewBroadcastResetPacket(), "reset"},
+	}
+	for _, tc := range tcs {
+		i, err := ParsePacket(tc.p.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i.String() != tc.str {
+			t.Errorf("expected %q, got %q", tc.str, i.String())
+		}
+	}
+}
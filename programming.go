@@ -0,0 +1,306 @@
+package dcc
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Service mode sequence lengths, as specified in the S-9.2.3 Service Mode
+// Standard.
+var (
+	// ServiceModePowerOnPackets specifies how many reset packets are
+	// sent after powering the programming track before any service
+	// mode instruction.
+	ServiceModePowerOnPackets = 20
+	// ServiceModeResetRepeat specifies how many reset packets are sent
+	// before a service mode instruction.
+	ServiceModeResetRepeat = 3
+	// ServiceModeCommandRepeat specifies how many times a service mode
+	// instruction is sent.
+	ServiceModeCommandRepeat = 5
+	// ServiceModeRecoveryRepeat specifies how many reset packets are
+	// sent after a service mode instruction to give decoders time to
+	// complete it.
+	ServiceModeRecoveryRepeat = 6
+	// AckWindow specifies how long to wait for a decoder
+	// acknowledgement after sending a service mode sequence.
+	AckWindow = 10 * time.Millisecond
+)
+
+// PageRegister is the decoder register used to select the page of
+// CVs accessible through registers 1-4 in paged addressing.
+const PageRegister = 6
+
+// Errors returned by ProgrammingTrack operations.
+var (
+	// ErrProgrammingTrackOff is returned when attempting to program a
+	// decoder while the programming track is not powered.
+	ErrProgrammingTrackOff = errors.New("programming track is not powered")
+	// ErrNoAckDetector is returned when attempting operations which
+	// need decoder acknowledgements with a Driver which does not
+	// implement AckDetector.
+	ErrNoAckDetector = errors.New("driver cannot detect acknowledgements")
+)
+
+// ProgrammingTrack represents a programming track, on which decoders
+// can be configured using service mode instructions. Unlike the
+// main tracks handled by a Controller, the programming track only
+// carries packets when a service mode operation is performed. It
+// should use its own Driver, separate from the Controller's one, and
+// its power is controlled separately with PowerOn() and PowerOff().
+//
+// Verify operations and ReadCV need a Driver which implements
+// AckDetector.
+type ProgrammingTrack struct {
+	driver Driver
+	mux    sync.Mutex
+
+	powered bool
+}
+
+// NewProgrammingTrack builds a ProgrammingTrack. The track is
+// not powered.
+func NewProgrammingTrack(d Driver) *ProgrammingTrack {
+	d.TracksOff()
+	return &ProgrammingTrack{
+		driver: d,
+	}
+}
+
+// PowerOn powers the programming track and performs the power-on
+// cycle, which gives decoders the time to start before receiving
+// service mode instructions. If the power-on packets cannot be sent,
+// the track is powered off again and the error is returned.
+func (pt *ProgrammingTrack) PowerOn() error {
+	pt.mux.Lock()
+	defer pt.mux.Unlock()
+	if pt.powered {
+		return nil
+	}
+	pt.driver.TracksOn()
+	err := pt.repeat(NewServiceModeResetPacket(), ServiceModePowerOnPackets)
+	if err != nil {
+		pt.driver.TracksOff()
+		return err
+	}
+	pt.powered = true
+	return nil
+}
+
+// PowerOff removes power from the programming track.
+func (pt *ProgrammingTrack) PowerOff() {
+	pt.mux.Lock()
+	defer pt.mux.Unlock()
+	pt.driver.TracksOff()
+	pt.powered = false
+}
+
+// Powered returns true if the programming track is powered.
+func (pt *ProgrammingTrack) Powered() bool {
+	pt.mux.Lock()
+	defer pt.mux.Unlock()
+	return pt.powered
+}
+
+func (pt *ProgrammingTrack) repeat(p *Packet, n int) error {
+	for i := 0; i < n; i++ {
+		if err := p.Send(pt.driver); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sequence sends a service mode instruction framed by reset packets:
+// resets, the repeated instruction and resets for decoder recovery.
+// It returns true if the decoder acknowledged the instruction.
+// It must be called with the lock held.
+func (pt *ProgrammingTrack) sequence(p *Packet) (bool, error) {
+	if !pt.powered {
+		return false, ErrProgrammingTrackOff
+	}
+	ackd, canAck := pt.driver.(AckDetector)
+	reset := NewServiceModeResetPacket()
+	if err := pt.repeat(reset, ServiceModeResetRepeat); err != nil {
+		return false, err
+	}
+	if canAck {
+		ackd.ResetAck()
+	}
+	if err := pt.repeat(p, ServiceModeCommandRepeat); err != nil {
+		return false, err
+	}
+	if err := pt.repeat(reset, ServiceModeRecoveryRepeat); err != nil {
+		return false, err
+	}
+	if canAck {
+		return ackd.Ack(AckWindow), nil
+	}
+	return false, nil
+}
+
+// run performs the given service mode sequences in order and
+// returns whether the last one was acknowledged.
+func (pt *ProgrammingTrack) run(pkts ...*Packet) (bool, error) {
+	pt.mux.Lock()
+	defer pt.mux.Unlock()
+	var ack bool
+	var err error
+	for _, p := range pkts {
+		ack, err = pt.sequence(p)
+		if err != nil {
+			return false, err
+		}
+	}
+	return ack, nil
+}
+
+// write performs the given write sequences.
+func (pt *ProgrammingTrack) write(pkts ...*Packet) error {
+	_, err := pt.run(pkts...)
+	return err
+}
+
+// verify performs the given sequences, the last one being a verify
+// instruction, and returns whether it was acknowledged.
+func (pt *ProgrammingTrack) verify(pkts ...*Packet) (bool, error) {
+	if _, ok := pt.driver.(AckDetector); !ok {
+		return false, ErrNoAckDetector
+	}
+	return pt.run(pkts...)
+}
+
+// writeOne performs a single write sequence, or returns the error
+// building its packet.
+func (pt *ProgrammingTrack) writeOne(p *Packet, err error) error {
+	if err != nil {
+		return err
+	}
+	return pt.write(p)
+}
+
+// verifyOne performs a single verify sequence, or returns the error
+// building its packet.
+func (pt *ProgrammingTrack) verifyOne(p *Packet, err error) (bool, error) {
+	if err != nil {
+		return false, err
+	}
+	return pt.verify(p)
+}
+
+// WriteCV writes a value to a configuration variable (1-1024) using
+// direct CV addressing.
+func (pt *ProgrammingTrack) WriteCV(cv uint16, value byte) error {
+	return pt.writeOne(NewDirectWriteBytePacket(cv, value))
+}
+
+// VerifyCV asks the decoder to verify the value of a configuration
+// variable (1-1024) using direct CV addressing. It returns true if
+// the decoder acknowledged that the CV holds the given value.
+func (pt *ProgrammingTrack) VerifyCV(cv uint16, value byte) (bool, error) {
+	return pt.verifyOne(NewDirectVerifyBytePacket(cv, value))
+}
+
+// WriteCVBit writes a single bit (0-7) of a configuration variable
+// (1-1024) using direct CV addressing.
+func (pt *ProgrammingTrack) WriteCVBit(cv uint16, bit uint8, value bool) error {
+	return pt.writeOne(NewDirectWriteBitPacket(cv, bit, value))
+}
+
+// VerifyCVBit asks the decoder to verify a single bit (0-7) of a
+// configuration variable (1-1024) using direct CV addressing. It returns
+// true if the decoder acknowledged that the bit has the given value.
+func (pt *ProgrammingTrack) VerifyCVBit(cv uint16, bit uint8, value bool) (bool, error) {
+	return pt.verifyOne(NewDirectVerifyBitPacket(cv, bit, value))
+}
+
+// pagedRegister returns the page and data register (1-4)
+// corresponding to a CV in paged addressing. Page 256 is
+// sent as 0.
+func pagedRegister(cv uint16) (byte, uint8) {
+	page := byte((cv-1)/4 + 1)
+	reg := uint8((cv-1)%4 + 1)
+	return page, reg
+}
+
+// pagedPackets returns the packets which preset the page register to
+// 1, select the page containing the CV and then access the data
+// register holding it.
+func (pt *ProgrammingTrack) pagedPackets(cv uint16, value byte, write bool) ([]*Packet, error) {
+	if err := checkCV(cv); err != nil {
+		return nil, err
+	}
+	page, reg := pagedRegister(cv)
+	preset, _ := NewRegisterWritePacket(PageRegister, 1)
+	selectPage, _ := NewRegisterWritePacket(PageRegister, page)
+	var data *Packet
+	if write {
+		data, _ = NewRegisterWritePacket(reg, value)
+	} else {
+		data, _ = NewRegisterVerifyPacket(reg, value)
+	}
+	return []*Packet{preset, selectPage, data}, nil
+}
+
+// WritePaged writes a value to a configuration variable (1-1024) using
+// paged addressing, supported by older decoders. The page register is
+// preset to 1 before selecting the page containing the CV.
+func (pt *ProgrammingTrack) WritePaged(cv uint16, value byte) error {
+	pkts, err := pt.pagedPackets(cv, value, true)
+	if err != nil {
+		return err
+	}
+	return pt.write(pkts...)
+}
+
+// VerifyPaged asks the decoder to verify the value of a configuration
+// variable (1-1024) using paged addressing. It returns true if the
+// decoder acknowledged that the CV holds the given value.
+func (pt *ProgrammingTrack) VerifyPaged(cv uint16, value byte) (bool, error) {
+	pkts, err := pt.pagedPackets(cv, value, false)
+	if err != nil {
+		return false, err
+	}
+	return pt.verify(pkts...)
+}
+
+// WriteRegister writes a value to a decoder register (1-8) using
+// physical register addressing, supported by older decoders.
+func (pt *ProgrammingTrack) WriteRegister(reg uint8, value byte) error {
+	return pt.writeOne(NewRegisterWritePacket(reg, value))
+}
+
+// VerifyRegister asks the decoder to verify the value of a decoder
+// register (1-8) using physical register addressing. It returns true if
+// the decoder acknowledged that the register holds the given value.
+func (pt *ProgrammingTrack) VerifyRegister(reg uint8, value byte) (bool, error) {
+	return pt.verifyOne(NewRegisterVerifyPacket(reg, value))
+}
+
+// ReadCV reads the value of a configuration variable (1-1024) using
+// direct CV addressing. Since decoders can only acknowledge, each bit is
+// obtained by asking the decoder to verify that it is set. The result is
+// then confirmed by verifying the whole byte.
+func (pt *ProgrammingTrack) ReadCV(cv uint16) (byte, error) {
+	var value byte
+	for bit := uint8(0); bit < 8; bit++ {
+		set, err := pt.VerifyCVBit(cv, bit, true)
+		if err != nil {
+			return 0, err
+		}
+		if set {
+			value = value | (1 << bit)
+		}
+	}
+
+	ok, err := pt.VerifyCV(cv, value)
+	if err != nil {
+		return 0, err
+	}
+	if !ok {
+		return 0, fmt.Errorf("reading CV%d: decoder did not confirm value %d", cv, value)
+	}
+	return value, nil
+}
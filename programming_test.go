@@ -0,0 +1,124 @@
+package dcc
+
+import (
+	"testing"
+
+	"github.com/hsanjuan/go-dcc/clock"
+	"github.com/hsanjuan/go-dcc/driver/dummy"
+)
+
+// virtualDummy returns a dummy driver measuring time with a virtual
+// clock. Packets are sent as waveforms, so the decoder simulation does
+// not depend on scheduling delays.
+func virtualDummy(cvs map[uint16]byte) *dummy.DCCDummy {
+	return &dummy.DCCDummy{CVs: cvs, Time: &clock.Virtual{}}
+}
+
+func TestProgrammingTrackPower(t *testing.T) {
+	pt := NewProgrammingTrack(&dummy.DCCDummy{})
+	if pt.Powered() {
+		t.Error("programming track should start powered off")
+	}
+	if err := pt.WriteCV(1, 3); err != ErrProgrammingTrackOff {
+		t.Error("should not program with the track off")
+	}
+	pt.PowerOn()
+	if !pt.Powered() {
+		t.Error("programming track should be powered")
+	}
+	pt.PowerOff()
+	if pt.Powered() {
+		t.Error("programming track should be powered off")
+	}
+}
+
+func TestProgrammingTrackOperations(t *testing.T) {
+	pt := NewProgrammingTrack(virtualDummy(nil))
+	pt.PowerOn()
+	defer pt.PowerOff()
+
+	ops := []func() (bool, error){
+		func() (bool, error) { return true, pt.WriteCV(1, 3) },
+		func() (bool, error) { return pt.VerifyCV(1, 3) },
+		func() (bool, error) { return true, pt.WriteCVBit(29, 1, true) },
+		func() (bool, error) { return pt.VerifyCVBit(29, 1, true) },
+		func() (bool, error) { return true, pt.WritePaged(5, 10) },
+		func() (bool, error) { return pt.VerifyPaged(5, 10) },
+		func() (bool, error) { return true, pt.WriteRegister(5, 6) },
+		func() (bool, error) { return pt.VerifyRegister(5, 6) },
+	}
+	for i, op := range ops {
+		ok, err := op()
+		if err != nil {
+			t.Errorf("operation %d failed: %s", i, err)
+		}
+		if !ok {
+			t.Errorf("operation %d was not acknowledged", i)
+		}
+	}
+}
+
+func TestProgrammingTrackReadCV(t *testing.T) {
+	d := virtualDummy(map[uint16]byte{8: 151})
+	pt := NewProgrammingTrack(d)
+	pt.PowerOn()
+	defer pt.PowerOff()
+
+	v, err := pt.ReadCV(8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v != 151 {
+		t.Error("read wrong CV value: ", v)
+	}
+
+	ok, err := pt.VerifyCV(8, 150)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok {
+		t.Error("should not have verified a wrong value")
+	}
+}
+
+type noAckDriver struct{}
+
+func (d noAckDriver) Low()       {}
+func (d noAckDriver) High()      {}
+func (d noAckDriver) TracksOn()  {}
+func (d noAckDriver) TracksOff() {}
+
+func TestProgrammingTrackNoAckDetector(t *testing.T) {
+	pt := NewProgrammingTrack(noAckDriver{})
+	pt.PowerOn()
+	if _, err := pt.VerifyCV(1, 3); err != ErrNoAckDetector {
+		t.Error("should need an AckDetector to verify")
+	}
+	if _, err := pt.ReadCV(1); err != ErrNoAckDetector {
+		t.Error("should need an AckDetector to read")
+	}
+	if err := pt.WriteCV(1, 3); err != nil {
+		t.Error("should be able to write without an AckDetector")
+	}
+}
+
+func TestPagedRegister(t *testing.T) {
+	tcs := []struct {
+		cv   uint16
+		page byte
+		reg  uint8
+	}{
+		{1, 1, 1},
+		{4, 1, 4},
+		{5, 2, 1},
+		{29, 8, 1},
+		{1024, 0, 4}, // page 256 wraps to 0
+	}
+	for _, tc := range tcs {
+		page, reg := pagedRegister(tc.cv)
+		if page != tc.page || reg != tc.reg {
+			t.Errorf("CV%d: expected page %d reg %d, got page %d reg %d",
+				tc.cv, tc.page, tc.reg, page, reg)
+		}
+	}
+}
@@ -0,0 +1,317 @@
+// Package railcom decodes the data that RailCom decoders send back to the
+// command station during the RailCom cutout (see dcc.RailComCutout).
+//
+// During each cutout, decoders send up to 2 bytes in channel 1 and up to 6
+// bytes in channel 2. Every byte uses the 4-of-8 code (four bits set) and
+// carries 6 bits of data, or one of the ACK, NACK and BUSY symbols. The
+// data bits form datagrams made of a 4-bit identifier followed by the
+// datagram payload. See the RCN-217 standard.
+package railcom
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Errors returned when decoding RailCom data. They are wrapped with
+// details about the problem, so use errors.Is to check for them.
+var (
+	// ErrBadCode is returned when a byte is not a valid
+	// 4-of-8 code.
+	ErrBadCode = errors.New("invalid 4-of-8 code")
+	// ErrBadLength is returned when a channel does not hold
+	// complete datagrams.
+	ErrBadLength = errors.New("incomplete datagram")
+	// ErrUnknownDatagram is returned when a datagram uses an
+	// identifier which is not supported.
+	ErrUnknownDatagram = errors.New("unknown datagram")
+)
+
+// Special symbols of the 4-of-8 code.
+const (
+	ackCode  = 0x0F
+	ack2Code = 0xF0 // alternative ACK
+	nackCode = 0x3C
+	busyCode = 0xE1
+)
+
+// encodeTable holds the 4-of-8 code for every 6-bit value.
+var encodeTable = [64]byte{
+	0xAC, 0xAA, 0xA9, 0xA5, 0xA3, 0xA6, 0x9C, 0x9A, // 0x00
+	0x99, 0x95, 0x93, 0x96, 0x8E, 0x8D, 0x8B, 0xB1, // 0x08
+	0xB2, 0xB4, 0xB8, 0x74, 0x72, 0x6C, 0x6A, 0x69, // 0x10
+	0x65, 0x63, 0x66, 0x5C, 0x5A, 0x59, 0x55, 0x53, // 0x18
+	0x56, 0x4E, 0x4D, 0x4B, 0x47, 0x71, 0xE8, 0xE4, // 0x20
+	0xE2, 0xD1, 0xC9, 0xC5, 0xD8, 0xD4, 0xD2, 0xCA, // 0x28
+	0xC6, 0xCC, 0x78, 0x17, 0x1B, 0x1D, 0x1E, 0x2E, // 0x30
+	0x36, 0x3A, 0x27, 0x2B, 0x2D, 0x35, 0x39, 0x33, // 0x38
+}
+
+// symbol values for codes which do not carry data.
+const (
+	invalid = 0xFF
+	ack     = 0x40
+	nack    = 0x41
+	busy    = 0x42
+)
+
+// decodeTable maps every byte to its 6-bit value or special symbol.
+var decodeTable [256]byte
+
+func init() {
+	for i := range decodeTable {
+		decodeTable[i] = invalid
+	}
+	for v, c := range encodeTable {
+		decodeTable[c] = byte(v)
+	}
+	decodeTable[ackCode] = ack
+	decodeTable[ack2Code] = ack
+	decodeTable[nackCode] = nack
+	decodeTable[busyCode] = busy
+}
+
+// Datagram identifiers.
+const (
+	IDPOM         = 0
+	IDAddressHigh = 1
+	IDAddressLow  = 2
+	IDDynamic     = 7
+	IDXPOM0       = 8
+	IDXPOM3       = 11
+)
+
+// Dynamic information subindexes.
+const (
+	DynSpeed1 = 0 // speed in km/h, 0-255
+	DynSpeed2 = 1 // speed in km/h, 256-511
+	DynQoS    = 7 // quality of service: percentage of packets lost
+)
+
+// Datagram is a piece of information sent by a decoder. Datagrams
+// are one of the types in this package.
+type Datagram interface {
+	// String returns a human-readable description of the datagram,
+	// like "address low 3" or "speed 45 km/h".
+	String() string
+}
+
+// AckDatagram acknowledges a packet addressed to the decoder.
+type AckDatagram struct{}
+
+// NackDatagram signals that the decoder does not support the
+// instruction it received.
+type NackDatagram struct{}
+
+// BusyDatagram signals that the decoder received the instruction
+// but cannot handle it yet.
+type BusyDatagram struct{}
+
+// AddressHighDatagram carries the high part of the decoder address.
+// Decoders send it in channel 1, alternating with AddressLowDatagram.
+type AddressHighDatagram struct {
+	Value byte
+}
+
+// AddressLowDatagram carries the low part of the decoder address.
+type AddressLowDatagram struct {
+	Value byte
+}
+
+// POMDatagram carries the value of a CV read using operations mode
+// programming.
+type POMDatagram struct {
+	Value byte
+}
+
+// XPOMDatagram carries the values of four consecutive CVs read using
+// extended operations mode programming. Sequence (0-3) matches the
+// sequence number of the request.
+type XPOMDatagram struct {
+	Sequence uint8
+	Values   [4]byte
+}
+
+// DynamicDatagram carries dynamic information about the decoder, like
+// its actual speed or the quality of the signal it receives. Subindex
+// identifies the information (see DynSpeed1, DynSpeed2, DynQoS).
+type DynamicDatagram struct {
+	Subindex uint8
+	Value    byte
+}
+
+func (d AckDatagram) String() string  { return "ack" }
+func (d NackDatagram) String() string { return "nack" }
+func (d BusyDatagram) String() string { return "busy" }
+
+func (d AddressHighDatagram) String() string {
+	return fmt.Sprintf("address high 0x%02x", d.Value)
+}
+
+func (d AddressLowDatagram) String() string {
+	return fmt.Sprintf("address low %d", d.Value)
+}
+
+func (d POMDatagram) String() string {
+	return fmt.Sprintf("pom %d", d.Value)
+}
+
+func (d XPOMDatagram) String() string {
+	return fmt.Sprintf("xpom %d %v", d.Sequence, d.Values)
+}
+
+func (d DynamicDatagram) String() string {
+	switch d.Subindex {
+	case DynSpeed1:
+		return fmt.Sprintf("speed %d km/h", d.Value)
+	case DynSpeed2:
+		return fmt.Sprintf("speed %d km/h", 256+int(d.Value))
+	case DynQoS:
+		return fmt.Sprintf("quality of service %d%%", d.Value)
+	default:
+		return fmt.Sprintf("dyn %d = %d", d.Subindex, d.Value)
+	}
+}
+
+// Address returns the locomotive address given by the high and low
+// address datagrams, and whether it is a long address. It returns
+// false when the high part does not correspond to a locomotive
+// address (i.e. it is a consist address).
+func Address(high AddressHighDatagram, low AddressLowDatagram) (uint16, bool, bool) {
+	switch {
+	case high.Value == 0:
+		return uint16(low.Value), false, true
+	case high.Value&0xC0 == 0x80:
+		return uint16(high.Value&0x3F)<<8 | uint16(low.Value), true, true
+	default:
+		return 0, false, false
+	}
+}
+
+// payloadBits returns the length of the datagrams with the given
+// identifier, including the identifier, or 0 if unknown.
+func payloadBits(id uint8) int {
+	switch {
+	case id == IDPOM, id == IDAddressHigh, id == IDAddressLow:
+		return 12
+	case id == IDDynamic:
+		return 18
+	case id >= IDXPOM0 && id <= IDXPOM3:
+		return 36
+	default:
+		return 0
+	}
+}
+
+// newDatagram builds a datagram from its identifier and payload.
+func newDatagram(id uint8, payload uint64) Datagram {
+	switch {
+	case id == IDPOM:
+		return POMDatagram{Value: byte(payload)}
+	case id == IDAddressHigh:
+		return AddressHighDatagram{Value: byte(payload)}
+	case id == IDAddressLow:
+		return AddressLowDatagram{Value: byte(payload)}
+	case id == IDDynamic:
+		return DynamicDatagram{
+			Value:    byte(payload >> 6),
+			Subindex: uint8(payload & 0x3F),
+		}
+	default: // XPOM
+		return XPOMDatagram{
+			Sequence: id - IDXPOM0,
+			Values: [4]byte{
+				byte(payload >> 24), byte(payload >> 16),
+				byte(payload >> 8), byte(payload),
+			},
+		}
+	}
+}
+
+// Decode decodes the bytes received in a RailCom channel into
+// datagrams. Channel 1 holds a single address datagram, while channel
+// 2 can hold several datagrams and ACK, NACK or BUSY symbols.
+func Decode(data []byte) ([]Datagram, error) {
+	var dgs []Datagram
+	var acc uint64 // bits of the current datagram
+	var n int      // number of bits in acc
+	for i, b := range data {
+		v := decodeTable[b]
+		switch v {
+		case invalid:
+			return nil, fmt.Errorf("%w: 0x%02x at byte %d", ErrBadCode, b, i)
+		case ack, nack, busy:
+			if n > 0 {
+				return nil, fmt.Errorf("%w: symbol 0x%02x at byte %d",
+					ErrBadLength, b, i)
+			}
+			dgs = append(dgs, special(v))
+			continue
+		}
+
+		acc = acc<<6 | uint64(v)
+		n += 6
+		id := uint8(acc >> (n - 4))
+		l := payloadBits(id)
+		if l == 0 {
+			return nil, fmt.Errorf("%w: id %d", ErrUnknownDatagram, id)
+		}
+		if n < l {
+			continue
+		}
+		dgs = append(dgs, newDatagram(id, acc&(1<<(l-4)-1)))
+		acc, n = 0, 0
+	}
+	if n > 0 {
+		return nil, fmt.Errorf("%w: %d bits left", ErrBadLength, n)
+	}
+	return dgs, nil
+}
+
+func special(v byte) Datagram {
+	switch v {
+	case ack:
+		return AckDatagram{}
+	case nack:
+		return NackDatagram{}
+	default:
+		return BusyDatagram{}
+	}
+}
+
+// Encode encodes datagrams into the bytes that a decoder would send.
+// It is useful to simulate decoders.
+func Encode(dgs ...Datagram) []byte {
+	var out []byte
+	add := func(id uint8, payload uint64) {
+		l := payloadBits(id)
+		bits := uint64(id)<<(l-4) | payload
+		for n := l - 6; n >= 0; n -= 6 {
+			out = append(out, encodeTable[(bits>>n)&0x3F])
+		}
+	}
+
+	for _, dg := range dgs {
+		switch d := dg.(type) {
+		case AckDatagram:
+			out = append(out, ackCode)
+		case NackDatagram:
+			out = append(out, nackCode)
+		case BusyDatagram:
+			out = append(out, busyCode)
+		case POMDatagram:
+			add(IDPOM, uint64(d.Value))
+		case AddressHighDatagram:
+			add(IDAddressHigh, uint64(d.Value))
+		case AddressLowDatagram:
+			add(IDAddressLow, uint64(d.Value))
+		case DynamicDatagram:
+			add(IDDynamic, uint64(d.Value)<<6|uint64(d.Subindex&0x3F))
+		case XPOMDatagram:
+			v := d.Values
+			add(IDXPOM0+d.Sequence&0x3, uint64(v[0])<<24|uint64(v[1])<<16|
+				uint64(v[2])<<8|uint64(v[3]))
+		}
+	}
+	return out
+}
@@ -0,0 +1,131 @@
+package railcom
+
+import (
+	"errors"
+	"math/bits"
+	"reflect"
+	"testing"
+)
+
+func TestCodeTable(t *testing.T) {
+	seen := make(map[byte]bool)
+	for v, c := range encodeTable {
+		if bits.OnesCount8(c) != 4 {
+			t.Errorf("code 0x%02x for %d does not have four ones", c, v)
+		}
+		if seen[c] {
+			t.Errorf("code 0x%02x is repeated", c)
+		}
+		seen[c] = true
+		if decodeTable[c] != byte(v) {
+			t.Errorf("code 0x%02x decodes to %d instead of %d", c, decodeTable[c], v)
+		}
+	}
+	for _, c := range []byte{ackCode, ack2Code, nackCode, busyCode} {
+		if bits.OnesCount8(c) != 4 || seen[c] {
+			t.Errorf("bad special code 0x%02x", c)
+		}
+	}
+}
+
+func TestDecode(t *testing.T) {
+	tcs := []struct {
+		data []byte
+		dgs  []Datagram
+	}{
+		{[]byte{0x9C, 0xAC}, []Datagram{AddressHighDatagram{Value: 0x80}}},
+		{[]byte{0x99, 0xA5}, []Datagram{AddressLowDatagram{Value: 3}}},
+		{[]byte{0x0F, 0xF0, 0x3C, 0xE1}, []Datagram{AckDatagram{}, AckDatagram{}, NackDatagram{}, BusyDatagram{}}},
+		{nil, nil},
+	}
+	for _, tc := range tcs {
+		dgs, err := Decode(tc.data)
+		if err != nil {
+			t.Errorf("% x: %s", tc.data, err)
+			continue
+		}
+		if !reflect.DeepEqual(dgs, tc.dgs) {
+			t.Errorf("% x: decoded %v, expected %v", tc.data, dgs, tc.dgs)
+		}
+	}
+}
+
+func TestEncode(t *testing.T) {
+	dgs := [][]Datagram{
+		{AddressHighDatagram{Value: 0x87}},
+		{AddressLowDatagram{Value: 0xD0}},
+		{POMDatagram{Value: 25}, AckDatagram{}, DynamicDatagram{Subindex: DynQoS, Value: 3}},
+		{DynamicDatagram{Subindex: DynSpeed1, Value: 45}, DynamicDatagram{Subindex: DynSpeed2, Value: 10}},
+		{XPOMDatagram{Sequence: 2, Values: [4]byte{1, 2, 3, 255}}},
+	}
+	for _, d := range dgs {
+		data := Encode(d...)
+		decoded, err := Decode(data)
+		if err != nil {
+			t.Errorf("%v: %s", d, err)
+			continue
+		}
+		if !reflect.DeepEqual(decoded, d) {
+			t.Errorf("decoded %v, expected %v", decoded, d)
+		}
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	tcs := []struct {
+		data []byte
+		err  error
+	}{
+		{[]byte{0xFF}, ErrBadCode},
+		{[]byte{0xA5}, ErrBadLength},
+		{[]byte{0xA5, 0x0F}, ErrBadLength},
+		{[]byte{0x74, 0xAC}, ErrUnknownDatagram}, // id 4
+		{Encode(DynamicDatagram{Value: 1})[:2], ErrBadLength},
+	}
+	for _, tc := range tcs {
+		_, err := Decode(tc.data)
+		if !errors.Is(err, tc.err) {
+			t.Errorf("% x: expected %s, got %v", tc.data, tc.err, err)
+		}
+	}
+}
+
+func TestAddress(t *testing.T) {
+	tcs := []struct {
+		high, low byte
+		addr      uint16
+		long, ok  bool
+	}{
+		{0x00, 3, 3, false, true},
+		{0x87, 0xD0, 2000, true, true},
+		{0x60, 10, 0, false, false},
+	}
+	for _, tc := range tcs {
+		addr, long, ok := Address(AddressHighDatagram{tc.high}, AddressLowDatagram{tc.low})
+		if addr != tc.addr || long != tc.long || ok != tc.ok {
+			t.Errorf("0x%02x 0x%02x: got %d %t %t", tc.high, tc.low, addr, long, ok)
+		}
+	}
+}
+
+func TestDatagramString(t *testing.T) {
+	tcs := []struct {
+		dg  Datagram
+		str string
+	}{
+		{AckDatagram{}, "ack"},
+		{AddressHighDatagram{Value: 0x80}, "address high 0x80"},
+		{AddressLowDatagram{Value: 3}, "address low 3"},
+		{POMDatagram{Value: 25}, "pom 25"},
+		{XPOMDatagram{Sequence: 1, Values: [4]byte{1, 2, 3, 4}}, "xpom 1 [1 2 3 4]"},
+		{DynamicDatagram{Subindex: DynSpeed1, Value: 45}, "speed 45 km/h"},
+		{DynamicDatagram{Subindex: DynSpeed2, Value: 4}, "speed 260 km/h"},
+		{DynamicDatagram{Subindex: DynQoS, Value: 3}, "quality of service 3%"},
+		{DynamicDatagram{Subindex: 26, Value: 40}, "dyn 26 = 40"},
+	}
+	for _, tc := range tcs {
+		if tc.dg.String() != tc.str {
+			t.Errorf("expected %q, got %q", tc.str, tc.dg.String())
+		}
+	}
+}
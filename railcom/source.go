@@ -0,0 +1,97 @@
+package railcom
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Channel sizes in bytes.
+const (
+	Channel1Bytes = 2
+	Channel2Bytes = 6
+)
+
+// Source provides the bytes received by a RailCom detector, i.e. a
+// detector connected to a serial port or a file with recorded data.
+type Source interface {
+	// ReadCutout returns the bytes received in channel 1 and
+	// channel 2 during the next cutout. Channels where nothing
+	// was received are empty.
+	ReadCutout() (ch1, ch2 []byte, err error)
+}
+
+// Reader is a Source reading from an io.Reader in which every cutout
+// takes 8 bytes: 2 for channel 1 followed by 6 for channel 2. Bytes
+// where nothing was received are set to 0x00, which is not a valid
+// 4-of-8 code.
+type Reader struct {
+	r   io.Reader
+	buf [Channel1Bytes + Channel2Bytes]byte
+}
+
+// NewReader returns a Reader.
+func NewReader(r io.Reader) *Reader {
+	return &Reader{r: r}
+}
+
+// ReadCutout reads the data for the next cutout. It returns io.EOF when
+// there is no more data.
+func (r *Reader) ReadCutout() ([]byte, []byte, error) {
+	if _, err := io.ReadFull(r.r, r.buf[:]); err != nil {
+		return nil, nil, err
+	}
+	return received(r.buf[:Channel1Bytes]), received(r.buf[Channel1Bytes:]), nil
+}
+
+// received returns a copy of the given bytes without the 0x00 bytes.
+func received(data []byte) []byte {
+	var out []byte
+	for _, b := range data {
+		if b != 0x00 {
+			out = append(out, b)
+		}
+	}
+	return out
+}
+
+// Cutout holds the datagrams received during a cutout.
+type Cutout struct {
+	Channel1 []Datagram
+	Channel2 []Datagram
+}
+
+// String returns a description of the datagrams received, like
+// "ch1 [address low 3] ch2 [pom 25]".
+func (c Cutout) String() string {
+	return fmt.Sprintf("ch1 [%s] ch2 [%s]", join(c.Channel1), join(c.Channel2))
+}
+
+func join(dgs []Datagram) string {
+	strs := make([]string, len(dgs))
+	for i, dg := range dgs {
+		strs[i] = dg.String()
+	}
+	return strings.Join(strs, ", ")
+}
+
+// Next reads the next cutout from a Source and decodes it.
+func Next(s Source) (Cutout, error) {
+	ch1, ch2, err := s.ReadCutout()
+	if err != nil {
+		return Cutout{}, err
+	}
+	if len(ch1) > Channel1Bytes || len(ch2) > Channel2Bytes {
+		return Cutout{}, fmt.Errorf("%w: %d bytes in channel 1 and %d in channel 2",
+			ErrBadLength, len(ch1), len(ch2))
+	}
+
+	var c Cutout
+	if c.Channel1, err = Decode(ch1); err != nil {
+		return Cutout{}, fmt.Errorf("channel 1: %w", err)
+	}
+	if c.Channel2, err = Decode(ch2); err != nil {
+		return Cutout{}, fmt.Errorf("channel 2: %w", err)
+	}
+	return c, nil
+}
@@ -0,0 +1,46 @@
+package railcom
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestReader(t *testing.T) {
+	var buf bytes.Buffer
+	// Cutout 1: address and POM response with ACK.
+	buf.Write(Encode(AddressLowDatagram{Value: 3}))
+	buf.Write(Encode(POMDatagram{Value: 25}, AckDatagram{}))
+	buf.Write([]byte{0x00, 0x00, 0x00})
+	// Cutout 2: nothing in channel 1, speed in channel 2.
+	buf.Write([]byte{0x00, 0x00})
+	buf.Write(Encode(DynamicDatagram{Subindex: DynSpeed1, Value: 45}))
+	buf.Write([]byte{0x00, 0x00, 0x00})
+	// Cutout 3: garbage.
+	buf.Write([]byte{0xFF, 0xFF, 0, 0, 0, 0, 0, 0})
+
+	r := NewReader(&buf)
+	c, err := Next(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.String() != "ch1 [address low 3] ch2 [pom 25, ack]" {
+		t.Error("bad cutout: ", c)
+	}
+
+	c, err = Next(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.String() != "ch1 [] ch2 [speed 45 km/h]" {
+		t.Error("bad cutout: ", c)
+	}
+
+	if _, err = Next(r); !errors.Is(err, ErrBadCode) {
+		t.Error("should fail with bad codes: ", err)
+	}
+	if _, err = Next(r); err != io.EOF {
+		t.Error("should return EOF: ", err)
+	}
+}
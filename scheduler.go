@@ -0,0 +1,342 @@
+package dcc
+
+import (
+	"fmt"
+	"time"
+)
+
+// Refresh intervals for the packets of every Locomotive. Once new or
+// changed packets have been sent CommandRepeat times, they are sent
+// again, in turns with the rest of locomotives, at these intervals.
+var (
+	SpeedRefreshInterval       = 100 * time.Millisecond
+	FunctionRefreshInterval    = 500 * time.Millisecond
+	BinaryStateRefreshInterval = 2 * time.Second
+)
+
+// AddressSeparation is the minimum time between the end of a packet
+// and the start of the next packet to the same decoder address, as
+// required by S-9.2.
+const AddressSeparation = 5 * time.Millisecond
+
+// scheduler decides which packet the Controller sends next.
+//
+// Commands, along with new and changed locomotive packets, have high
+// priority and are sent in the order they arrived. Otherwise, locomotive
+// packets are refreshed in turns (round-robin), each at the interval for
+// its kind. Packets to the same decoder address (see addressKey) are
+// separated by at least AddressSeparation, and packets to an address
+// with pending commands are held back, so commands to a decoder are
+// received in order and without other packets in between (i.e. both
+// operations mode packets).
+type scheduler struct {
+	urgent   []*urgentCmd
+	locos    map[*Locomotive]*locoEntries
+	order    []*Locomotive
+	next     int // next locomotive in turn
+	gen      uint64
+	lastSent map[string]time.Time
+	picked   *urgentCmd // last command returned by pick
+}
+
+// urgentCmd is a high priority command. Commands for locomotive packets
+// carry a key so that changed packets replace pending ones.
+type urgentCmd struct {
+	command
+	key  urgentKey
+	addr string
+}
+
+type urgentKey struct {
+	loco  *Locomotive
+	index int
+}
+
+// locoEntries holds the packets being refreshed for a Locomotive.
+type locoEntries struct {
+	entries []*refreshEntry
+	gen     uint64
+}
+
+type refreshEntry struct {
+	packet   *Packet
+	addr     string
+	interval time.Duration
+	last     time.Time
+}
+
+func newScheduler() *scheduler {
+	return &scheduler{
+		locos:    make(map[*Locomotive]*locoEntries),
+		lastSent: make(map[string]time.Time),
+	}
+}
+
+// push queues a command with high priority.
+func (s *scheduler) push(cmd command) {
+	if cmd.repeat <= 0 {
+		if cmd.handle != nil {
+			cmd.handle.finish(nil)
+		}
+		return
+	}
+	s.urgent = append(s.urgent, &urgentCmd{
+		command: cmd,
+		addr:    addressKey(cmd.packet),
+	})
+}
+
+// remove removes the high priority command at position i.
+func (s *scheduler) remove(i int) {
+	copy(s.urgent[i:], s.urgent[i+1:])
+	s.urgent[len(s.urgent)-1] = nil
+	s.urgent = s.urgent[:len(s.urgent)-1]
+}
+
+// dropCanceled removes the submitted commands whose context is done.
+func (s *scheduler) dropCanceled() {
+	for i := 0; i < len(s.urgent); i++ {
+		if h := s.urgent[i].handle; h != nil && h.canceled() {
+			s.remove(i)
+			i--
+		}
+	}
+}
+
+// update sets the packets of a Locomotive. New and changed packets are
+// queued with high priority. Locomotives which are not updated between
+// two calls to prune are forgotten.
+func (s *scheduler) update(l *Locomotive, pkts []*Packet, now time.Time) {
+	le, ok := s.locos[l]
+	if !ok {
+		le = &locoEntries{}
+		s.locos[l] = le
+		s.order = append(s.order, l)
+	}
+	le.gen = s.gen
+
+	if sameEntries(le.entries, pkts) {
+		return
+	}
+	entries := make([]*refreshEntry, len(pkts))
+	for i, p := range pkts {
+		if i < len(le.entries) && le.entries[i].packet.Equal(p) {
+			entries[i] = le.entries[i]
+			continue
+		}
+		entries[i] = &refreshEntry{
+			packet:   p,
+			addr:     addressKey(p),
+			interval: refreshInterval(p),
+			last:     now,
+		}
+		s.pushLoco(urgentKey{l, i}, p)
+	}
+	le.entries = entries
+}
+
+func sameEntries(entries []*refreshEntry, pkts []*Packet) bool {
+	if len(entries) != len(pkts) {
+		return false
+	}
+	for i, p := range pkts {
+		if entries[i].packet != p && !entries[i].packet.Equal(p) {
+			return false
+		}
+	}
+	return true
+}
+
+// pushLoco queues a locomotive packet with high priority, replacing
+// any pending one with the same key.
+func (s *scheduler) pushLoco(key urgentKey, p *Packet) {
+	for _, u := range s.urgent {
+		if u.key == key {
+			u.packet = p
+			u.addr = addressKey(p)
+			u.repeat = CommandRepeat
+			return
+		}
+	}
+	if CommandRepeat > 0 {
+		s.urgent = append(s.urgent, &urgentCmd{
+			command: command{packet: p, repeat: CommandRepeat},
+			key:     key,
+			addr:    addressKey(p),
+		})
+	}
+}
+
+// prune forgets the locomotives which were not updated since the
+// last call.
+func (s *scheduler) prune() {
+	order := s.order[:0]
+	for _, l := range s.order {
+		if s.locos[l].gen == s.gen {
+			order = append(order, l)
+		} else {
+			delete(s.locos, l)
+		}
+	}
+	for i := len(order); i < len(s.order); i++ {
+		s.order[i] = nil
+	}
+	s.order = order
+	if s.next >= len(s.order) {
+		s.next = 0
+	}
+	s.gen++
+}
+
+// refreshInterval returns the refresh interval for a packet depending
+// on its instruction.
+func refreshInterval(p *Packet) time.Duration {
+	i, err := ParseFrame(p.Bytes())
+	if err != nil {
+		return FunctionRefreshInterval
+	}
+	switch i.(type) {
+	case SpeedInstruction:
+		return SpeedRefreshInterval
+	case BinaryStateInstruction:
+		return BinaryStateRefreshInterval
+	default:
+		return FunctionRefreshInterval
+	}
+}
+
+// addressKey identifies the decoder a packet is for. Multi-function
+// decoders are identified by their address bytes, while accessory
+// addresses continue in the first data byte and are decoded. Packets
+// which cannot be decoded are identified by their address bytes.
+func addressKey(p *Packet) string {
+	i, err := ParseFrame(p.Bytes())
+	if err != nil {
+		return string(p.address)
+	}
+	switch i := i.(type) {
+	case BasicAccessoryInstruction:
+		return fmt.Sprintf("accessory %d", i.Decoder)
+	case ExtendedAccessoryInstruction:
+		return fmt.Sprintf("extended accessory %d", i.OutputAddress())
+	default:
+		return string(p.address)
+	}
+}
+
+// ready returns true if a packet can be sent to the given address.
+func (s *scheduler) ready(addr string, now time.Time) bool {
+	last, ok := s.lastSent[addr]
+	return !ok || now.Sub(last) >= AddressSeparation
+}
+
+// pending returns true if there are high priority commands for the given
+// address before position n. Locomotive packets only count when locos is
+// true.
+func (s *scheduler) pending(addr string, n int, locos bool) bool {
+	for _, u := range s.urgent[:n] {
+		if u.addr == addr && (locos || u.key.loco == nil) {
+			return true
+		}
+	}
+	return false
+}
+
+// pick returns the next packet to send, or nil if there is nothing to
+// send at this moment. Locomotive packets, both new or changed ones and
+// refreshes, are only sent when refresh is true. Otherwise, new and
+// changed ones stay queued, and only commands are sent.
+func (s *scheduler) pick(now time.Time, refresh bool) *Packet {
+	s.picked = nil
+	s.dropCanceled()
+	for i, u := range s.urgent {
+		addr := u.addr
+		if (!refresh && u.key.loco != nil) ||
+			s.pending(addr, i, refresh) || !s.ready(addr, now) {
+			continue
+		}
+		p := u.packet
+		u.repeat--
+		if u.repeat <= 0 {
+			s.refreshed(u.key, p, now)
+			s.remove(i)
+		}
+		s.picked = u
+		return p
+	}
+
+	if !refresh {
+		return nil
+	}
+	for n := 0; n < len(s.order); n++ {
+		i := (s.next + n) % len(s.order)
+		for _, e := range s.locos[s.order[i]].entries {
+			addr := e.addr
+			if now.Sub(e.last) < e.interval ||
+				s.pending(addr, len(s.urgent), true) || !s.ready(addr, now) {
+				continue
+			}
+			e.last = now
+			s.next = (i + 1) % len(s.order)
+			return e.packet
+		}
+	}
+	return nil
+}
+
+// refreshed restarts the refresh interval of a locomotive packet once
+// it has been sent with high priority.
+func (s *scheduler) refreshed(key urgentKey, p *Packet, now time.Time) {
+	le, ok := s.locos[key.loco]
+	if !ok || key.index >= len(le.entries) {
+		return
+	}
+	if e := le.entries[key.index]; e.packet == p {
+		e.last = now
+	}
+}
+
+// sent records that a packet was sent. Submitted commands are resolved
+// once their last repetition is sent. It returns true when the packet
+// was the last repetition of a command.
+func (s *scheduler) sent(p *Packet, now time.Time) bool {
+	s.lastSent[addressKey(p)] = now
+	u := s.picked
+	s.picked = nil
+	if u == nil || u.repeat > 0 || u.key.loco != nil {
+		return false
+	}
+	if u.handle != nil {
+		u.handle.finish(nil)
+	}
+	return true
+}
+
+// failed records that sending the last picked packet failed. Submitted
+// commands fail with the given error and are not sent again.
+func (s *scheduler) failed(err error) {
+	u := s.picked
+	s.picked = nil
+	if u == nil || u.handle == nil {
+		return
+	}
+	u.handle.finish(err)
+	for i := range s.urgent {
+		if s.urgent[i] == u {
+			s.remove(i)
+			return
+		}
+	}
+}
+
+// stop fails all the pending submitted commands with the given error
+// and clears the queue.
+func (s *scheduler) stop(err error) {
+	for _, u := range s.urgent {
+		if u.handle != nil {
+			u.handle.finish(err)
+		}
+	}
+	s.urgent = nil
+	s.picked = nil
+}
@@ -0,0 +1,225 @@
+package dcc
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSchedulerCommands(t *testing.T) {
+	must := mustBuild(t)
+	s := newScheduler()
+	now := time.Time{}
+
+	a1 := must(NewFunctionGroupOnePacket(Address{Number: 3}, true, false, false, false, false))
+	a2 := must(NewFunctionGroupOnePacket(Address{Number: 3}, false, false, false, false, false))
+	b := must(NewFunctionGroupOnePacket(Address{Number: 4}, true, false, false, false, false))
+	s.push(command{packet: a1, repeat: 2})
+	s.push(command{packet: a2, repeat: 1})
+	s.push(command{packet: b, repeat: 1})
+	s.push(command{packet: b, repeat: 0}) // ignored
+
+	pick := func(expected *Packet) {
+		t.Helper()
+		p := s.pick(now, true)
+		if p != expected {
+			t.Fatalf("expected %v, got %v", expected, p)
+		}
+		if p != nil {
+			s.sent(p, now)
+		}
+	}
+
+	pick(a1)
+	pick(b) // address 3 must wait
+	pick(nil)
+	now = now.Add(AddressSeparation)
+	pick(a1)
+	pick(nil)
+	now = now.Add(AddressSeparation)
+	pick(a2) // in order
+	pick(nil)
+}
+
+func TestSchedulerAccessories(t *testing.T) {
+	must := mustBuild(t)
+	s := newScheduler()
+	now := time.Time{}
+
+	// Decoders 64 apart share the first address byte.
+	a1 := must(NewAccessoryOutputPacket(5, 0, true))
+	a2 := must(NewAccessoryOutputPacket(6, 0, true)) // same decoder
+	b := must(NewAccessoryOutputPacket(5+64*4, 0, true))
+	if a1.Bytes()[0] != b.Bytes()[0] {
+		t.Fatal("packets should share the first byte")
+	}
+	s.push(command{packet: a1, repeat: 1})
+	s.push(command{packet: a2, repeat: 1})
+	s.push(command{packet: b, repeat: 1})
+
+	for _, expected := range []*Packet{a1, b, nil} {
+		p := s.pick(now, true)
+		if p != expected {
+			t.Fatalf("expected %v, got %v", expected, p)
+		}
+		if p != nil {
+			s.sent(p, now)
+		}
+	}
+	now = now.Add(AddressSeparation)
+	if p := s.pick(now, true); p != a2 {
+		t.Fatal("should send to the same decoder after AddressSeparation: ", p)
+	}
+}
+
+func TestSchedulerRefresh(t *testing.T) {
+	s := newScheduler()
+	now := time.Time{}
+	l := &Locomotive{Name: "abc", Address: 3}
+	pkts, err := l.packets()
+	if err != nil {
+		t.Fatal(err)
+	}
+	speed, fl := pkts[0], pkts[1]
+
+	next := func() *Packet {
+		s.update(l, pkts, now)
+		s.prune()
+		p := s.pick(now, true)
+		if p != nil {
+			s.sent(p, now)
+		}
+		return p
+	}
+
+	// New packets are sent CommandRepeat times each.
+	for i := 0; i < 2*CommandRepeat; i++ {
+		expected := speed
+		if i >= CommandRepeat {
+			expected = fl
+		}
+		if p := next(); p != expected {
+			t.Fatalf("packet %d: expected %s, got %v", i, expected.Describe(), p)
+		}
+		now = now.Add(AddressSeparation)
+	}
+
+	// Then the speed is refreshed first.
+	if p := next(); p != nil {
+		t.Fatal("nothing should be sent before the refresh interval: ", p)
+	}
+	now = now.Add(SpeedRefreshInterval)
+	if p := next(); p != speed {
+		t.Fatal("speed should have been refreshed: ", p)
+	}
+
+	// Changed packets go first and replace pending ones.
+	l.Speed = 10
+	l.speedPacket = nil
+	changed, err := l.packets()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.update(l, changed, now)
+	l.Speed = 12
+	l.speedPacket = nil
+	pkts, err = l.packets()
+	if err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(FunctionRefreshInterval)
+	for i := 0; i < CommandRepeat; i++ {
+		if p := next(); p != pkts[0] {
+			t.Fatalf("packet %d: expected %s, got %v", i, pkts[0].Describe(), p)
+		}
+		now = now.Add(AddressSeparation)
+	}
+	if p := next(); p != fl {
+		t.Error("functions should be refreshed after the changes: ", p)
+	}
+
+	// Nothing is refreshed when asked not to.
+	now = now.Add(BinaryStateRefreshInterval)
+	if p := s.pick(now, false); p != nil {
+		t.Error("should not refresh packets: ", p)
+	}
+}
+
+func TestSchedulerHold(t *testing.T) {
+	must := mustBuild(t)
+	s := newScheduler()
+	now := time.Time{}
+	l := &Locomotive{Name: "abc", Address: 3}
+	pkts, err := l.packets()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.update(l, pkts, now)
+	cmd := must(NewPOMWriteBytePacket(Address{Number: 3}, 3, 20))
+	s.push(command{packet: cmd, repeat: 1})
+
+	// Queued locomotive packets are held back, and do not hold back
+	// commands to the same address.
+	if p := s.pick(now, false); p != cmd {
+		t.Fatal("should only send the command: ", p)
+	}
+	s.sent(cmd, now)
+	now = now.Add(AddressSeparation)
+	if p := s.pick(now, false); p != nil {
+		t.Fatal("should not send locomotive packets: ", p)
+	}
+	if p := s.pick(now, true); p != pkts[0] {
+		t.Fatal("should send the held packets afterwards: ", p)
+	}
+}
+
+func TestSchedulerPrune(t *testing.T) {
+	s := newScheduler()
+	now := time.Time{}
+	l1 := &Locomotive{Name: "abc", Address: 3}
+	l2 := &Locomotive{Name: "def", Address: 4}
+	p1, _ := l1.packets()
+	p2, _ := l2.packets()
+
+	s.update(l1, p1, now)
+	s.update(l2, p2, now)
+	s.prune()
+	s.update(l2, p2, now)
+	s.prune()
+	if _, ok := s.locos[l1]; ok || len(s.order) != 1 {
+		t.Fatal("l1 should have been forgotten")
+	}
+
+	// Pending packets for l1 are still sent, but not refreshed.
+	seen := make(map[*Packet]int)
+	for i := 0; i < 8*CommandRepeat; i++ {
+		if p := s.pick(now, true); p != nil {
+			seen[p]++
+			s.sent(p, now)
+		}
+		now = now.Add(AddressSeparation)
+	}
+	if seen[p1[0]] != CommandRepeat {
+		t.Errorf("l1 speed sent %d times", seen[p1[0]])
+	}
+	if seen[p2[0]] <= CommandRepeat {
+		t.Errorf("l2 speed should have been refreshed: sent %d times", seen[p2[0]])
+	}
+}
+
+func TestRefreshInterval(t *testing.T) {
+	must := mustBuild(t)
+	addr := Address{Number: 3}
+	tcs := []struct {
+		p        *Packet
+		interval time.Duration
+	}{
+		{must(NewSpeedAndDirectionPacket(addr, Speed{Step: 3}, Forward)), SpeedRefreshInterval},
+		{must(NewFunctionGroupOnePacket(addr, true, false, false, false, false)), FunctionRefreshInterval},
+		{must(NewBinaryStatePacket(addr, 100, true)), BinaryStateRefreshInterval},
+	}
+	for _, tc := range tcs {
+		if i := refreshInterval(tc.p); i != tc.interval {
+			t.Errorf("%s: expected %s, got %s", tc.p.Describe(), tc.interval, i)
+		}
+	}
+}
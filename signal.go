@@ -0,0 +1,92 @@
+package dcc
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// DefaultAspects maps aspect names to the aspect numbers sent to
+// signals which do not define their own Aspects.
+var DefaultAspects = map[string]byte{
+	"stop":     0,
+	"clear":    1,
+	"approach": 2,
+}
+
+// Signal represents a signal operated by an extended accessory decoder.
+// Signals are represented by their name and their output address
+// (1-2044). Aspects maps aspect names (i.e. "clear", "approach",
+// "stop") to the aspect numbers understood by the decoder. When not
+// set, DefaultAspects is used. Aspect holds the name of the last aspect
+// set for the signal. Once the signal is in use by a Controller, read
+// it with CurrentAspect.
+type Signal struct {
+	Name    string          `json:"name"`
+	Address uint16          `json:"address"`
+	Aspect  string          `json:"aspect"`
+	Aspects map[string]byte `json:"aspects,omitempty"`
+
+	mux sync.Mutex
+}
+
+// CurrentAspect returns the name of the last aspect set for the
+// signal.
+func (s *Signal) CurrentAspect() string {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return s.Aspect
+}
+
+func (s *Signal) setAspect(aspect string) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.Aspect = aspect
+}
+
+// MarshalJSON encodes the signal. Unlike encoding the fields
+// directly, it is safe to call while the signal is in use.
+func (s *Signal) MarshalJSON() ([]byte, error) {
+	type plain Signal // without MarshalJSON
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return json.Marshal((*plain)(s))
+}
+
+func (s *Signal) String() string {
+	return fmt.Sprintf("%s:%d |%s|", s.Name, s.Address, s.CurrentAspect())
+}
+
+func (s *Signal) aspects() map[string]byte {
+	if s.Aspects != nil {
+		return s.Aspects
+	}
+	return DefaultAspects
+}
+
+// AspectNames returns the sorted names of the aspects supported by
+// the signal.
+func (s *Signal) AspectNames() []string {
+	aspects := s.aspects()
+	names := make([]string, 0, len(aspects))
+	for n := range aspects {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// packet returns the packet to set the given aspect. It returns an
+// error if the aspect is not known.
+func (s *Signal) packet(aspect string) (*Packet, error) {
+	n, ok := s.aspects()[aspect]
+	if !ok {
+		return nil, fmt.Errorf("signal %s has no aspect %q", s.Name, aspect)
+	}
+	p, err := NewExtendedAccessoryPacket(s.Address, n)
+	if err != nil {
+		return nil, fmt.Errorf("signal %s: %w", s.Name, err)
+	}
+	return p, nil
+}
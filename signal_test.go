@@ -0,0 +1,40 @@
+package dcc
+
+import (
+	"testing"
+)
+
+func TestSignalPacket(t *testing.T) {
+	must := mustBuild(t)
+	s := &Signal{
+		Name:    "s1",
+		Address: 20,
+		Aspects: map[string]byte{"stop": 0, "proceed": 5},
+	}
+	p, err := s.packet("proceed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.String() != must(NewExtendedAccessoryPacket(20, 5)).String() {
+		t.Error("bad signal packet")
+	}
+
+	if _, err := s.packet("clear"); err == nil {
+		t.Error("should not use default aspects when Aspects is set")
+	}
+}
+
+func TestSignalAspectNames(t *testing.T) {
+	s := &Signal{Name: "s1", Address: 20}
+	names := s.AspectNames()
+	if len(names) != 3 || names[0] != "approach" || names[1] != "clear" || names[2] != "stop" {
+		t.Error("bad default aspect names: ", names)
+	}
+}
+
+func TestSignalString(t *testing.T) {
+	s := &Signal{Name: "s1", Address: 20, Aspect: "stop"}
+	if s.String() != "s1:20 |stop|" {
+		t.Error("bad string: ", s.String())
+	}
+}
@@ -0,0 +1,91 @@
+package dcc
+
+// Speed step modes.
+const (
+	SpeedSteps14  SpeedSteps = 14
+	SpeedSteps28  SpeedSteps = 28
+	SpeedSteps128 SpeedSteps = 128
+)
+
+// SpeedSteps represents the number of speed steps a locomotive
+// decoder is configured to use. The zero value means 28 steps.
+//
+// 14 and 28 speed steps are controlled with the baseline speed and
+// direction instruction, while 128 speed steps are controlled with the
+// advanced operations instruction. In 14-step mode, the bit that 28-step
+// mode uses for intermediate steps controls the headlight (FL) instead.
+type SpeedSteps uint8
+
+// Max returns the highest speed step available in this mode. This is 14,
+// 28 or 126, as two of the 128 values are reserved for stop and emergency
+// stop.
+func (s SpeedSteps) Max() uint8 {
+	switch s {
+	case SpeedSteps14:
+		return 14
+	case SpeedSteps128:
+		return 126
+	default:
+		return 28
+	}
+}
+
+// Speed represents a locomotive speed as a step number in a given speed
+// step mode. Step 0 stops the locomotive normally, and steps above the
+// mode's maximum are treated as full speed. When EStop is set, the speed
+// instruction requests an emergency stop and Step is ignored.
+type Speed struct {
+	Step  uint8
+	Steps SpeedSteps
+	EStop bool
+}
+
+func (s Speed) step() uint8 {
+	if max := s.Steps.Max(); s.Step > max {
+		return max
+	}
+	return s.Step
+}
+
+// baseline returns the speed bits for the baseline speed and direction
+// instruction. In 28-step mode these are 5 bits in the order CSSSS, where
+// C is the least significant bit of the speed. In 14-step mode only the 4
+// SSSS bits are used.
+func (s Speed) baseline() byte {
+	if s.Steps == SpeedSteps14 {
+		switch {
+		case s.EStop:
+			return 0x01
+		case s.Step == 0:
+			return 0x00
+		default:
+			return s.step() + 1 // 0b0010-0b1111
+		}
+	}
+
+	var v byte
+	switch {
+	case s.EStop:
+		v = 0x02
+	case s.Step == 0:
+		v = 0x00
+	default:
+		v = s.step() + 3 // 0b00100-0b11111
+	}
+	return (v&0x1)<<4 | v>>1
+}
+
+// advanced returns the 7 speed bits for the 128 speed step control
+// instruction. The step is always interpreted in 128-step mode.
+func (s Speed) advanced() byte {
+	switch {
+	case s.EStop:
+		return 0x01
+	case s.Step == 0:
+		return 0x00
+	case s.Step > SpeedSteps128.Max():
+		return SpeedSteps128.Max() + 1
+	default:
+		return s.Step + 1
+	}
+}
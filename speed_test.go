@@ -0,0 +1,58 @@
+package dcc
+
+import "testing"
+
+func TestSpeedStepsMax(t *testing.T) {
+	if SpeedSteps(0).Max() != 28 ||
+		SpeedSteps14.Max() != 14 ||
+		SpeedSteps28.Max() != 28 ||
+		SpeedSteps128.Max() != 126 {
+		t.Error("bad maximum speed steps")
+	}
+}
+
+func TestSpeedBaseline(t *testing.T) {
+	tcs := []struct {
+		speed    Speed
+		expected byte // CSSSS
+	}{
+		{Speed{Step: 0}, 0x00},
+		{Speed{EStop: true}, 0x01},
+		{Speed{Step: 1}, 0x02},
+		{Speed{Step: 2}, 0x12},
+		{Speed{Step: 5}, 0x04},
+		{Speed{Step: 27}, 0x0F},
+		{Speed{Step: 28}, 0x1F},
+		{Speed{Step: 40}, 0x1F},
+		{Speed{Step: 0, Steps: SpeedSteps14}, 0x00},
+		{Speed{EStop: true, Steps: SpeedSteps14}, 0x01},
+		{Speed{Step: 1, Steps: SpeedSteps14}, 0x02},
+		{Speed{Step: 14, Steps: SpeedSteps14}, 0x0F},
+		{Speed{Step: 20, Steps: SpeedSteps14}, 0x0F},
+	}
+
+	for _, tc := range tcs {
+		if b := tc.speed.baseline(); b != tc.expected {
+			t.Errorf("%+v: expected %05b but got %05b", tc.speed, tc.expected, b)
+		}
+	}
+}
+
+func TestSpeedAdvanced(t *testing.T) {
+	tcs := []struct {
+		speed    Speed
+		expected byte
+	}{
+		{Speed{Step: 0}, 0x00},
+		{Speed{EStop: true}, 0x01},
+		{Speed{Step: 1}, 0x02},
+		{Speed{Step: 126}, 0x7F},
+		{Speed{Step: 200}, 0x7F},
+	}
+
+	for _, tc := range tcs {
+		if b := tc.speed.advanced(); b != tc.expected {
+			t.Errorf("%+v: expected %07b but got %07b", tc.speed, tc.expected, b)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package dcc
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// ErrStopped is returned for submitted packets which had not been
+// sent when the Controller was stopped.
+var ErrStopped = errors.New("controller stopped")
+
+// SubmitOptions controls how a submitted packet is sent.
+type SubmitOptions struct {
+	// Repeat specifies how many times the packet is sent.
+	// When 0, the packet is sent CommandRepeat times.
+	Repeat int
+}
+
+// Handle tracks a packet submitted to a Controller with Submit.
+type Handle struct {
+	ctx  context.Context
+	done chan struct{}
+	once sync.Once
+	err  error
+}
+
+func newHandle(ctx context.Context) *Handle {
+	return &Handle{
+		ctx:  ctx,
+		done: make(chan struct{}),
+	}
+}
+
+// finish resolves the handle. Only the first call has effect.
+func (h *Handle) finish(err error) {
+	h.once.Do(func() {
+		h.err = err
+		close(h.done)
+	})
+}
+
+// canceled returns true when the context for the submission is done.
+func (h *Handle) canceled() bool {
+	if h.ctx.Err() != nil {
+		h.finish(h.ctx.Err())
+		return true
+	}
+	return false
+}
+
+// Done returns a channel which is closed when the packet has been sent
+// the requested number of times or the submission has failed.
+func (h *Handle) Done() <-chan struct{} {
+	return h.done
+}
+
+// Err returns nil when the packet has been sent the requested number of
+// times. Otherwise, it returns the error that made the submission fail:
+// the context error on cancellation, ErrStopped when the Controller
+// stopped first, or the Driver error. It returns nil until Done is
+// closed.
+func (h *Handle) Err() error {
+	select {
+	case <-h.done:
+		return h.err
+	default:
+		return nil
+	}
+}
+
+// Wait blocks until the packet has been sent the requested number of
+// times, the submission fails or its context is done, and returns the
+// result as given by Err.
+func (h *Handle) Wait() error {
+	select {
+	case <-h.done:
+	case <-h.ctx.Done():
+		h.finish(h.ctx.Err())
+	}
+	return h.err
+}
+
+// Submit queues a packet to be sent to the tracks with high priority,
+// like Command, and returns a Handle which resolves once the packet has
+// been sent. Options may be nil.
+//
+// Submit blocks while the command queue is full (see CommandMaxQueue)
+// and fails when the context is done first, or with ErrStopped when the
+// Controller stops first. Cancelling the context after Submit returns
+// stops any pending repetitions of the packet. It returns ErrNotRunning
+// when the Controller is not running.
+func (c *Controller) Submit(ctx context.Context, p *Packet, opts *SubmitOptions) (*Handle, error) {
+	if p == nil {
+		return nil, errors.New("cannot submit a nil packet")
+	}
+	repeat := CommandRepeat
+	if opts != nil && opts.Repeat > 0 {
+		repeat = opts.Repeat
+	}
+
+	c.queueMux.RLock()
+	defer c.queueMux.RUnlock()
+	if c.shutdownCh == nil {
+		return nil, ErrNotRunning
+	}
+	h := newHandle(ctx)
+	select {
+	case c.commandCh <- command{packet: p, repeat: repeat, handle: h}:
+		return h, nil
+	case <-c.shutdownCh:
+		return nil, ErrStopped
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
@@ -0,0 +1,145 @@
+package dcc
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hsanjuan/go-dcc/clock"
+	"github.com/hsanjuan/go-dcc/driver/dummy"
+)
+
+func TestSubmit(t *testing.T) {
+	must := mustBuild(t)
+	c := NewController(&dummy.DCCDummy{Time: &clock.Virtual{}})
+	p := must(NewFunctionGroupOnePacket(Address{Number: 3}, true, false, false, false, false))
+
+	var mux sync.Mutex
+	count := 0
+	c.SetPacketHook(func(sent *Packet) {
+		if sent == p {
+			mux.Lock()
+			count++
+			mux.Unlock()
+		}
+	})
+
+	if _, err := c.Submit(context.Background(), p, nil); !errors.Is(err, ErrNotRunning) {
+		t.Error("should not submit before starting: ", err)
+	}
+	c.Start()
+	defer c.Stop()
+	h, err := c.Submit(context.Background(), p, &SubmitOptions{Repeat: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.Err() != nil {
+		t.Error("should not have an error before being sent")
+	}
+	if err := h.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	mux.Lock()
+	if count != 3 {
+		t.Errorf("packet sent %d times instead of 3", count)
+	}
+	mux.Unlock()
+	select {
+	case <-h.Done():
+	default:
+		t.Error("Done should be closed")
+	}
+
+	if _, err := c.Submit(context.Background(), nil, nil); err == nil {
+		t.Error("should not submit nil packets")
+	}
+	h, err = c.Submit(context.Background(), p, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	mux.Lock()
+	if count != 3+CommandRepeat {
+		t.Errorf("packet should be sent CommandRepeat times by default: %d", count)
+	}
+	mux.Unlock()
+}
+
+func TestSubmitCancel(t *testing.T) {
+	must := mustBuild(t)
+	c := NewController(&dummy.DCCDummy{Time: &clock.Virtual{}})
+	p := must(NewFunctionGroupOnePacket(Address{Number: 3}, true, false, false, false, false))
+
+	// Fill the queue.
+	stopAccepting := acceptCommands(c)
+	ctx, cancel := context.WithCancel(context.Background())
+	var handles []*Handle
+	for i := 0; i < CommandMaxQueue; i++ {
+		h, err := c.Submit(ctx, p, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		handles = append(handles, h)
+	}
+
+	timeout, cancelTimeout := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancelTimeout()
+	if _, err := c.Submit(timeout, p, nil); !errors.Is(err, context.DeadlineExceeded) {
+		t.Error("should fail when the queue is full and the context expires: ", err)
+	}
+
+	cancel()
+	stopAccepting()
+	for _, h := range handles {
+		if err := h.Wait(); !errors.Is(err, context.Canceled) {
+			t.Error("should have been cancelled: ", err)
+		}
+	}
+
+	// Cancelled packets are not sent.
+	sent := make(chan *Packet, 100)
+	c.SetPacketHook(func(p *Packet) {
+		select {
+		case sent <- p:
+		default:
+		}
+	})
+	c.Start()
+	defer c.Stop()
+	for i := 0; i < 50; i++ {
+		if got := <-sent; got == p {
+			t.Fatal("cancelled packet should not be sent")
+		}
+	}
+}
+
+func TestSubmitStop(t *testing.T) {
+	must := mustBuild(t)
+	c := NewController(&dummy.DCCDummy{Time: &clock.Virtual{}})
+	p := must(NewFunctionGroupOnePacket(Address{Number: 3}, true, false, false, false, false))
+	sent := make(chan struct{})
+	var once sync.Once
+	c.SetPacketHook(func(got *Packet) {
+		if got == p {
+			once.Do(func() { close(sent) })
+		}
+	})
+
+	c.Start()
+	h, err := c.Submit(context.Background(), p, &SubmitOptions{Repeat: 1000000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-sent
+	c.Stop()
+	if err := h.Wait(); !errors.Is(err, ErrStopped) {
+		t.Error("should fail with ErrStopped: ", err)
+	}
+	if _, err := c.Submit(context.Background(), p, nil); !errors.Is(err, ErrNotRunning) {
+		t.Error("should not submit after stopping: ", err)
+	}
+}
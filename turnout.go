@@ -0,0 +1,79 @@
+package dcc
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+)
+
+// AccessoryRepeat specifies how many times accessory decoder
+// packets are sent.
+var AccessoryRepeat = 4
+
+// Turnout outputs. Following common practice, the first output of a
+// pair sets the turnout to the diverging route (thrown) and the second
+// one to the straight route (closed).
+const (
+	TurnoutThrownOutput uint8 = 0
+	TurnoutClosedOutput uint8 = 1
+)
+
+// Turnout represents a turnout (or switch) operated by a basic
+// accessory decoder. Turnouts are represented by their name and
+// their output address (1-2044), which selects the decoder and
+// output pair controlling them. Thrown holds the last state set
+// for the turnout. Once the turnout is in use by a Controller, read
+// it with IsThrown.
+type Turnout struct {
+	Name    string `json:"name"`
+	Address uint16 `json:"address"`
+	Thrown  bool   `json:"thrown"`
+
+	mux sync.Mutex
+}
+
+// IsThrown returns true if the turnout was last set to the
+// diverging route.
+func (t *Turnout) IsThrown() bool {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	return t.Thrown
+}
+
+func (t *Turnout) setThrown(thrown bool) {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	t.Thrown = thrown
+}
+
+// MarshalJSON encodes the turnout. Unlike encoding the fields
+// directly, it is safe to call while the turnout is in use.
+func (t *Turnout) MarshalJSON() ([]byte, error) {
+	type plain Turnout // without MarshalJSON
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	return json.Marshal((*plain)(t))
+}
+
+func (t *Turnout) String() string {
+	state := "closed"
+	if t.IsThrown() {
+		state = "thrown"
+	}
+	return fmt.Sprintf("%s:%d |%s|", t.Name, t.Address, state)
+}
+
+// packets returns the packets to activate and deactivate
+// the turnout output corresponding to the given state.
+func (t *Turnout) packets(thrown bool) (*Packet, *Packet, error) {
+	output := TurnoutClosedOutput
+	if thrown {
+		output = TurnoutThrownOutput
+	}
+	on, err := NewAccessoryOutputPacket(t.Address, output, true)
+	if err != nil {
+		return nil, nil, fmt.Errorf("turnout %s: %w", t.Name, err)
+	}
+	off, _ := NewAccessoryOutputPacket(t.Address, output, false)
+	return on, off, nil
+}
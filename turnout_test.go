@@ -0,0 +1,66 @@
+package dcc
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/hsanjuan/go-dcc/clock"
+	"github.com/hsanjuan/go-dcc/driver/dummy"
+)
+
+func TestTurnoutPackets(t *testing.T) {
+	must := mustBuild(t)
+	to := &Turnout{Name: "t1", Address: 10}
+	on, off, err := to.packets(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if on.String() != must(NewAccessoryOutputPacket(10, 0, true)).String() {
+		t.Error("bad activation packet")
+	}
+	if off.String() != must(NewAccessoryOutputPacket(10, 0, false)).String() {
+		t.Error("bad deactivation packet")
+	}
+
+	to.Address = 0
+	if _, _, err := to.packets(true); !errors.Is(err, ErrBadAddress) {
+		t.Error("should fail with a bad address: ", err)
+	}
+}
+
+func TestTurnoutString(t *testing.T) {
+	to := &Turnout{Name: "t1", Address: 10, Thrown: true}
+	if to.String() != "t1:10 |thrown|" {
+		t.Error("bad string: ", to.String())
+	}
+}
+
+func TestTurnoutConcurrent(t *testing.T) {
+	c := NewController(&dummy.DCCDummy{Time: &clock.Virtual{}})
+	to := &Turnout{Name: "t1", Address: 10}
+	c.AddTurnout(to)
+	c.Start()
+	defer c.Stop()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 20; i++ {
+			_ = to.String()
+			if _, err := json.Marshal(&Config{Turnouts: c.Turnouts()}); err != nil {
+				t.Error(err)
+			}
+		}
+	}()
+	for i := 0; i < 20; i++ {
+		if err := c.ThrowTurnout(to); err != nil {
+			t.Fatal(err)
+		}
+		c.CloseTurnout(to)
+	}
+	<-done
+	if to.IsThrown() {
+		t.Error("turnout should be closed")
+	}
+}